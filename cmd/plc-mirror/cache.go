@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/nuts-foundation/go-did/did"
+)
+
+// documentCacheTTL limits how long a document can be served from the cache
+// if an invalidation was lost, e.g. when a replica has missed
+// a notification from the leader.
+const documentCacheTTL = 10 * time.Minute
+
+// cachedDocument is a rendered DID document, together with the operation
+// it was rendered from.
+type cachedDocument struct {
+	CID       string
+	CreatedAt string
+	// Document is nil if the DID is deleted.
+	Document *did.Document
+}
+
+// documentCache is an LRU cache of rendered DID documents. A nil
+// *documentCache is a valid disabled cache.
+type documentCache struct {
+	lru *expirable.LRU[string, cachedDocument]
+
+	// generation is incremented on every invalidation. It's used to avoid
+	// caching documents that were read from the database before
+	// a concurrent invalidation.
+	mu         sync.Mutex
+	generation uint64
+}
+
+func newDocumentCache(size int) *documentCache {
+	if size <= 0 {
+		return nil
+	}
+	return &documentCache{lru: expirable.NewLRU[string, cachedDocument](size, nil, documentCacheTTL)}
+}
+
+// Get returns a cached document. If there isn't one, it returns
+// the current generation that needs to be passed to Add after reading
+// the document from the database.
+func (c *documentCache) Get(did string) (cachedDocument, uint64, bool) {
+	if c == nil {
+		return cachedDocument{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc, ok := c.lru.Get(did)
+	if ok {
+		documentCacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		documentCacheRequests.WithLabelValues("miss").Inc()
+	}
+	return doc, c.generation, ok
+}
+
+// Add stores a document, unless anything was invalidated since
+// the corresponding Get call.
+func (c *documentCache) Add(did string, doc cachedDocument, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	c.lru.Add(did, doc)
+}
+
+// Invalidate removes documents of the given DIDs. If `dids` is nil,
+// the whole cache is purged.
+func (c *documentCache) Invalidate(dids []string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if dids == nil {
+		c.lru.Purge()
+		return
+	}
+	for _, did := range dids {
+		c.lru.Remove(did)
+	}
+}
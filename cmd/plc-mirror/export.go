@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/rs/zerolog"
+
+	"bsky.watch/plc-mirror/schema"
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+const (
+	defaultExportCount = 10
+	maxExportCount     = 1000
+)
+
+// exportEntry is the format of /export entries. Unlike audit log entries,
+// they include the sequence number.
+type exportEntry struct {
+	logEntry
+	Seq int64 `json:"seq,omitempty"`
+}
+
+func toExportEntry(e plc.OperationLogEntry) exportEntry {
+	return exportEntry{logEntry: toLogEntry(e), Seq: e.Seq}
+}
+
+// jsonLinesResponse writes entries as newline-delimited JSON, same as
+// plc.directory does for /export.
+type jsonLinesResponse []exportEntry
+
+func (r jsonLinesResponse) Respond(w http.ResponseWriter, req *http.Request) error {
+	w.Header().Set("Content-Type", "application/jsonlines")
+	encoder := json.NewEncoder(w)
+	for _, entry := range r {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) serveExport(ctx context.Context, req *http.Request, updateMetrics func(int)) convreq.HttpResponse {
+	log := zerolog.Ctx(ctx)
+
+	exporter, ok := s.db.(schema.Exporter)
+	if !ok {
+		updateMetrics(http.StatusNotImplemented)
+		return respond.NotImplemented("export is not supported by the current database schema")
+	}
+
+	params := req.URL.Query()
+	after := params.Get("after")
+	count := defaultExportCount
+	if v := params.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			updateMetrics(http.StatusBadRequest)
+			return respond.BadRequest("invalid count")
+		}
+		count = min(n, maxExportCount)
+	}
+
+	// Timestamps are never valid integers, so if `after` is a number,
+	// it's a sequence number.
+	var entries []plc.OperationLogEntry
+	var err error
+	if seq, convErr := strconv.ParseInt(after, 10, 64); convErr == nil {
+		entries, err = exporter.ExportBySeq(ctx, seq, count)
+	} else {
+		entries, err = exporter.Export(ctx, after, count)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to export log entries after %q: %s", after, err)
+		updateMetrics(http.StatusInternalServerError)
+		return respond.InternalServerError("failed to export log entries")
+	}
+
+	updateMetrics(http.StatusOK)
+	return jsonLinesResponse(mapSlice(entries, toExportEntry))
+}
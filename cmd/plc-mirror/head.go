@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+// headRefreshInterval is how often the head timestamp and the last
+// completion time are re-read from the database. On Postgres replicas
+// they're also re-read whenever the leader announces an update.
+const headRefreshInterval = 5 * time.Second
+
+// refreshHead reads the head timestamp and the last completion time from
+// the database, so that requests can be served without querying them.
+func (m *Mirror) refreshHead(ctx context.Context) error {
+	var head time.Time
+	ts, err := m.db.HeadTimestamp(ctx)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("getting head timestamp: %w", err)
+	}
+	if ts != "" {
+		head, err = time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return fmt.Errorf("parsing timestamp %q: %w", ts, err)
+		}
+	}
+	shared, err := m.db.LastCompletion(ctx)
+	if err != nil {
+		return fmt.Errorf("getting last completion time: %w", err)
+	}
+
+	m.mu.Lock()
+	if head.After(m.headTimestamp) {
+		m.headTimestamp = head
+	}
+	if shared.After(m.sharedLastCompletion) {
+		m.sharedLastCompletion = shared
+	}
+	m.mu.Unlock()
+
+	mirrorStaleness.Set(m.Staleness().Seconds())
+	return nil
+}
+
+// trackHead keeps the in-memory head timestamp up to date.
+func (m *Mirror) trackHead(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("module", "head").Logger()
+	ticker := time.NewTicker(headRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.headRefresh:
+		}
+		if err := m.refreshHead(ctx); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msgf("Failed to refresh head timestamp: %s", err)
+		}
+	}
+}
+
+// requestHeadRefresh makes trackHead re-read the head timestamp without
+// waiting for the next tick.
+func (m *Mirror) requestHeadRefresh() {
+	select {
+	case m.headRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// advanceHead is called after storing new entries, so that the leader
+// doesn't need to wait for a refresh.
+func (m *Mirror) advanceHead(t time.Time) {
+	m.mu.Lock()
+	if t.After(m.headTimestamp) {
+		m.headTimestamp = t
+	}
+	m.mu.Unlock()
+}
+
+// LastRecordTimestamp returns the timestamp of the newest stored operation.
+func (m *Mirror) LastRecordTimestamp() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.headTimestamp
+}
+
+// LastCompletion returns the last time when any replica has finished
+// polling upstream successfully.
+func (m *Mirror) LastCompletion() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.sharedLastCompletion.After(m.lastCompletionTimestamp) {
+		return m.sharedLastCompletion
+	}
+	return m.lastCompletionTimestamp
+}
+
+// Staleness returns how long ago the mirror was last known to be
+// up to date with upstream.
+func (m *Mirror) Staleness() time.Duration {
+	t := m.LastRecordTimestamp()
+	if lc := m.LastCompletion(); lc.After(t) {
+		t = lc
+	}
+	return time.Since(t)
+}
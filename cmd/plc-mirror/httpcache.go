@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+type notModified struct{}
+
+// Respond implements convreq.HttpResponse.
+func (notModified) Respond(w http.ResponseWriter, r *http.Request) error {
+	w.WriteHeader(http.StatusNotModified)
+	return nil
+}
+
+// cacheable adds ETag, Last-Modified and Cache-Control headers to
+// the response produced by `render`, which must be fully determined by
+// the operation with the given CID and timestamp. If the client already has
+// the same version, `render` is not called and 304 is returned instead.
+func (s *Server) cacheable(req *http.Request, cid string, createdAt string, updateMetrics func(int), render func() convreq.HttpResponse) convreq.HttpResponse {
+	// Weak, since the order of services and verification methods
+	// in the output is not stable.
+	etag := fmt.Sprintf("W/%q", cid)
+
+	headers := http.Header{}
+	headers.Set("ETag", etag)
+	lastModified, err := time.Parse(time.RFC3339, createdAt)
+	if err == nil {
+		headers.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if s.CacheMaxAge > 0 {
+		headers.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.CacheMaxAge.Seconds())))
+	} else {
+		// Without an explicit max-age caches would use a heuristic based
+		// on Last-Modified, which can be months for an old DID.
+		headers.Set("Cache-Control", "no-cache")
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			updateMetrics(http.StatusNotModified)
+			return respond.WithHeaders(notModified{}, headers)
+		}
+	} else if ims, perr := http.ParseTime(req.Header.Get("If-Modified-Since")); perr == nil && err == nil {
+		// If-Modified-Since is ignored if If-None-Match is present.
+		if !lastModified.Truncate(time.Second).After(ims) {
+			updateMetrics(http.StatusNotModified)
+			return respond.WithHeaders(notModified{}, headers)
+		}
+	}
+
+	return respond.WithHeaders(render(), headers)
+}
+
+// etagMatches implements weak comparison of If-None-Match header value
+// against an ETag.
+func etagMatches(header string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheableLog is the same as cacheable, but for responses derived
+// from the whole log of a DID. Validators are taken from the most recent
+// entry, which changes whenever anything in the log changes:
+// nullification is always caused by a new operation.
+func (s *Server) cacheableLog(req *http.Request, entries []plc.OperationLogEntry, updateMetrics func(int), render func() convreq.HttpResponse) convreq.HttpResponse {
+	if len(entries) == 0 {
+		return render()
+	}
+	newest := entries[0]
+	for _, e := range entries[1:] {
+		if e.CreatedAt >= newest.CreatedAt {
+			newest = e
+		}
+	}
+	return s.cacheable(req, newest.CID, newest.CreatedAt, updateMetrics, render)
+}
+
+// freshnessHeaders adds headers describing how far behind the mirror is
+// to the response. Stale responses always get them, and shared caches are
+// told to revalidate instead of storing stale data for max-age. While the
+// mirror is up to date the headers are left out of responses that shared
+// caches may store, since cached copies would keep the values long after
+// they stop being accurate. Upstream responses never get them, as they
+// don't depend on the mirror's state.
+type freshnessHeaders struct {
+	parent  convreq.HttpResponse
+	headers http.Header
+	stale   bool
+}
+
+// Respond implements convreq.HttpResponse.
+func (f freshnessHeaders) Respond(w http.ResponseWriter, r *http.Request) error {
+	return f.parent.Respond(&freshnessWriter{ResponseWriter: w, headers: f.headers, stale: f.stale}, r)
+}
+
+// freshnessWriter adds the headers right before the status line is written,
+// when the caching policy of the response is already known.
+type freshnessWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	stale       bool
+	wroteHeader bool
+}
+
+func (w *freshnessWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		sharedCacheable := strings.Contains(h.Get("Cache-Control"), "max-age")
+		switch {
+		case h.Get("X-PLC-Mirror-Source") != "":
+		case w.stale:
+			if sharedCacheable {
+				h.Set("Cache-Control", "no-cache")
+			}
+			for k, v := range w.headers {
+				h[k] = v
+			}
+		case !sharedCacheable:
+			for k, v := range w.headers {
+				h[k] = v
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *freshnessWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *freshnessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
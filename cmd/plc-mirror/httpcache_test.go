@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+)
+
+func TestETagMatches(t *testing.T) {
+	etag := `W/"bafyabc"`
+	cases := []struct {
+		header string
+		want   bool
+	}{
+		{`W/"bafyabc"`, true},
+		{`"bafyabc"`, true},
+		{`*`, true},
+		{`"other", W/"bafyabc"`, true},
+		{`"other",W/"bafyabc"`, true},
+		{` "bafyabc" `, true},
+		{`"other"`, false},
+		{`W/"other", "bafyab"`, false},
+		{`bafyabc`, false},
+		{`W/"bafyabc`, false},
+	}
+	for _, tc := range cases {
+		if got := etagMatches(tc.header, etag); got != tc.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tc.header, etag, got, tc.want)
+		}
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	const (
+		cid = "bafyabc"
+		// Sub-second part is not representable in Last-Modified.
+		createdAt = "2024-05-01T12:00:00.500Z"
+	)
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"no validators", nil, http.StatusOK},
+		{"matching etag", map[string]string{"If-None-Match": `W/"bafyabc"`}, http.StatusNotModified},
+		{"other etag", map[string]string{"If-None-Match": `W/"other"`}, http.StatusOK},
+		{"same second", map[string]string{"If-Modified-Since": lastModified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{"later", map[string]string{"If-Modified-Since": lastModified.Add(time.Hour).Format(http.TimeFormat)}, http.StatusNotModified},
+		{"second before", map[string]string{"If-Modified-Since": lastModified.Add(-time.Second).Format(http.TimeFormat)}, http.StatusOK},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+		{"etag takes precedence over date", map[string]string{
+			"If-None-Match":     `W/"other"`,
+			"If-Modified-Since": lastModified.Add(time.Hour).Format(http.TimeFormat),
+		}, http.StatusOK},
+		{"date ignored with matching etag", map[string]string{
+			"If-None-Match":     `W/"bafyabc"`,
+			"If-Modified-Since": lastModified.Add(-time.Hour).Format(http.TimeFormat),
+		}, http.StatusNotModified},
+	}
+
+	s := &Server{CacheMaxAge: time.Minute}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/did:plc:test", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+
+			metricsStatus := 0
+			rendered := false
+			resp := s.cacheable(req, cid, createdAt, func(code int) { metricsStatus = code }, func() convreq.HttpResponse {
+				rendered = true
+				return respond.String("ok")
+			})
+			w := httptest.NewRecorder()
+			if err := resp.Respond(w, req); err != nil {
+				t.Fatalf("Respond: %s", err)
+			}
+
+			if w.Code != tc.want {
+				t.Errorf("status = %d, want %d", w.Code, tc.want)
+			}
+			if tc.want == http.StatusNotModified {
+				if rendered {
+					t.Errorf("render was called for a 304 response")
+				}
+				if metricsStatus != http.StatusNotModified {
+					t.Errorf("metrics status = %d, want %d", metricsStatus, http.StatusNotModified)
+				}
+			}
+			if got := w.Header().Get("ETag"); got != `W/"bafyabc"` {
+				t.Errorf("ETag = %q", got)
+			}
+			if got := w.Header().Get("Last-Modified"); got != lastModified.Format(http.TimeFormat) {
+				t.Errorf("Last-Modified = %q", got)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "public, max-age=60" {
+				t.Errorf("Cache-Control = %q", got)
+			}
+		})
+	}
+}
+
+func TestFreshnessHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("X-PLC-Mirror-Lag", "5")
+
+	shared := func(resp convreq.HttpResponse) convreq.HttpResponse {
+		return respond.WithHeader(resp, "Cache-Control", "public, max-age=60")
+	}
+	cases := []struct {
+		name             string
+		resp             convreq.HttpResponse
+		stale            bool
+		want             bool
+		wantCacheControl string
+	}{
+		{"plain", respond.String("ok"), false, true, ""},
+		{"not found", respond.NotFound("unknown DID"), false, true, ""},
+		{"revalidated", respond.WithHeader(respond.String("ok"), "Cache-Control", "no-cache"), false, true, "no-cache"},
+		{"shared cache", shared(respond.String("ok")), false, false, "public, max-age=60"},
+		{"not modified", shared(notModified{}), false, false, "public, max-age=60"},
+		{"upstream", respond.WithHeader(respond.String("ok"), "X-PLC-Mirror-Source", "upstream"), false, false, ""},
+		{"stale", respond.String("ok"), true, true, ""},
+		{"stale shared cache", shared(respond.String("ok")), true, true, "no-cache"},
+		{"stale not modified", shared(notModified{}), true, true, "no-cache"},
+		{"stale upstream", respond.WithHeader(respond.String("ok"), "X-PLC-Mirror-Source", "upstream"), true, false, ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/did:plc:test", nil)
+		w := httptest.NewRecorder()
+		if err := (freshnessHeaders{parent: tc.resp, headers: headers, stale: tc.stale}).Respond(w, req); err != nil {
+			t.Fatalf("%s: Respond: %s", tc.name, err)
+		}
+		if got := w.Header().Get("X-PLC-Mirror-Lag") != ""; got != tc.want {
+			t.Errorf("%s: has X-PLC-Mirror-Lag = %v, want %v", tc.name, got, tc.want)
+		}
+		if got := w.Header().Get("Cache-Control"); got != tc.wantCacheControl {
+			t.Errorf("%s: Cache-Control = %q, want %q", tc.name, got, tc.wantCacheControl)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"bsky.watch/plc-mirror/schema"
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+// ingester checks new entries received from upstream against the logs
+// already stored in the database and applies PLC fork rules.
+type ingester struct {
+	db     schema.Database
+	verify bool
+}
+
+// Process returns entries that need to be appended to the database, and
+// already stored entries that need to be marked as nullified. Entries that
+// failed verification are logged, counted in metrics and omitted.
+func (in *ingester) Process(ctx context.Context, entries []plc.OperationLogEntry) ([]plc.OperationLogEntry, map[string][]string, error) {
+	log := zerolog.Ctx(ctx)
+
+	dids := []string{}
+	for _, entry := range entries {
+		dids = append(dids, entry.DID)
+	}
+	// Per-DID logs, with accepted entries from the current batch
+	// appended at the end.
+	var logs map[string][]plc.OperationLogEntry
+	var err error
+	if in.verify {
+		logs, err = in.db.AuditLogsForDIDs(ctx, dids)
+	} else {
+		logs, err = in.knownLogs(ctx, entries, dids)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetching existing logs: %w", err)
+	}
+
+	pending := []plc.OperationLogEntry{}
+	nullified := map[string]map[string]bool{}
+
+entries:
+	for _, entry := range entries {
+		known := logs[entry.DID]
+		for _, e := range known {
+			if e.CID == entry.CID {
+				// Already stored or seen earlier in this batch.
+				continue entries
+			}
+		}
+
+		if in.verify {
+			if err := verifyEntry(known, entry); err != nil {
+				in.reject(ctx, entry, err)
+				continue
+			}
+		}
+
+		// Don't trust the flag from upstream, we'll figure it out ourselves.
+		entry.Nullified = false
+		cids, err := plc.Nullifies(known, entry)
+		switch {
+		case errors.Is(err, plc.ErrPrevNotFound):
+			// Can happen only if verification is disabled. We can't
+			// apply fork rules without the previous operation,
+			// so just store it as is.
+			log.Warn().Err(err).Str("did", entry.DID).Str("cid", entry.CID).
+				Msgf("Can't apply fork rules to %q for %q: %s", entry.CID, entry.DID, err)
+		case err != nil:
+			in.reject(ctx, entry, &verificationError{reason: "invalid_fork", err: err})
+			continue
+		}
+
+		if len(cids) > 0 {
+			log.Info().Str("did", entry.DID).Str("cid", entry.CID).
+				Msgf("Operation %q for %q nullifies %v", entry.CID, entry.DID, cids)
+			if nullified[entry.DID] == nil {
+				nullified[entry.DID] = map[string]bool{}
+			}
+			for _, cid := range cids {
+				nullified[entry.DID][cid] = true
+			}
+			for i := range known {
+				if nullified[entry.DID][known[i].CID] {
+					known[i].Nullified = true
+				}
+			}
+		}
+
+		logs[entry.DID] = append(known, entry)
+		pending = append(pending, entry)
+	}
+
+	// Entries that are not stored yet don't need a separate update.
+	for i := range pending {
+		if nullified[pending[i].DID][pending[i].CID] {
+			pending[i].Nullified = true
+			delete(nullified[pending[i].DID], pending[i].CID)
+		}
+	}
+	toNullify := map[string][]string{}
+	for did, cids := range nullified {
+		for cid := range cids {
+			toNullify[did] = append(toNullify[did], cid)
+		}
+	}
+
+	return pending, toNullify, nil
+}
+
+// knownLogs returns enough of the stored logs to apply fork rules to
+// `entries` without verifying them. Nearly all operations are either
+// genesis operations for new DIDs or regular updates of the chain head,
+// and for those only the last operation is needed. Complete logs are
+// fetched only for DIDs with entries that don't extend their chain head,
+// i.e. forks, duplicates and genesis operations for existing DIDs.
+func (in *ingester) knownLogs(ctx context.Context, entries []plc.OperationLogEntry, dids []string) (map[string][]plc.OperationLogEntry, error) {
+	last, err := in.db.LastOperationsForDIDs(ctx, dids)
+	if err != nil {
+		return nil, err
+	}
+
+	heads := map[string]string{}
+	for did, entry := range last {
+		heads[did] = entry.CID
+	}
+	needFull := []string{}
+	for _, entry := range entries {
+		if heads[entry.DID] == plc.PrevCID(entry.Operation.Value) {
+			heads[entry.DID] = entry.CID
+			continue
+		}
+		needFull = append(needFull, entry.DID)
+	}
+
+	logs, err := in.db.AuditLogsForDIDs(ctx, needFull)
+	if err != nil {
+		return nil, err
+	}
+	for did, entry := range last {
+		if _, ok := logs[did]; !ok {
+			logs[did] = []plc.OperationLogEntry{*entry}
+		}
+	}
+	return logs, nil
+}
+
+func (in *ingester) reject(ctx context.Context, entry plc.OperationLogEntry, err error) {
+	verr := &verificationError{reason: "unknown", err: err}
+	errors.As(err, &verr)
+	verificationFailures.WithLabelValues(verr.reason).Inc()
+	zerolog.Ctx(ctx).Warn().Err(err).Str("did", entry.DID).Str("cid", entry.CID).
+		Msgf("Operation %q for %q failed verification: %s", entry.CID, entry.DID, err)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/rs/zerolog"
+
+	"bsky.watch/plc-mirror/schema"
+)
+
+// lookupResult is the format of the /lookup response.
+type lookupResult struct {
+	AlsoKnownAs string   `json:"alsoKnownAs"`
+	DIDs        []string `json:"dids"`
+}
+
+// serveLookup returns all DIDs that currently claim a given handle
+// (`?handle=alice.example.com`) or any other alsoKnownAs URI
+// (`?aka=at://alice.example.com`). More than one DID in the response
+// means that the claim is disputed.
+func (s *Server) serveLookup(ctx context.Context, req *http.Request, updateMetrics func(int)) convreq.HttpResponse {
+	log := zerolog.Ctx(ctx)
+
+	index, ok := s.db.(schema.AlsoKnownAsIndex)
+	if !ok {
+		updateMetrics(http.StatusNotImplemented)
+		return respond.NotImplemented("lookups are not supported by the current database schema")
+	}
+
+	params := req.URL.Query()
+	uri := params.Get("aka")
+	if handle := params.Get("handle"); handle != "" {
+		uri = "at://" + strings.TrimPrefix(handle, "@")
+	}
+	if uri == "" {
+		updateMetrics(http.StatusBadRequest)
+		return respond.BadRequest("either 'handle' or 'aka' parameter is required")
+	}
+
+	dids, err := index.DIDsByAlsoKnownAs(ctx, uri)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to look up %q: %s", uri, err)
+		updateMetrics(http.StatusInternalServerError)
+		return respond.InternalServerError("failed to look up DIDs")
+	}
+
+	updateMetrics(http.StatusOK)
+	return respond.JSON(lookupResult{AlsoKnownAs: uri, DIDs: dids})
+}
@@ -23,12 +23,17 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
 	"bsky.watch/plc-mirror/schema"
+	"bsky.watch/plc-mirror/schema/kv"
+	v1 "bsky.watch/plc-mirror/schema/v1"
 	"bsky.watch/plc-mirror/util/gormzerolog"
+	"bsky.watch/plc-mirror/util/leader"
 	"bsky.watch/plc-mirror/util/pglock"
 )
 
@@ -37,9 +42,42 @@ type Config struct {
 	LogFormat   string `default:"text"`
 	LogLevel    int64  `default:"1"`
 	MetricsPort string `split_words:"true"`
-	DBUrl       string `envconfig:"POSTGRES_URL"`
-	Upstream    string `default:"https://plc.directory"`
-	LockID      int64  `default:"6515824"`
+	// Use "sqlite:/path/to/file.db" for a local SQLite database,
+	// or "bolt:/path/to/file.db" for a local bbolt database.
+	DBUrl string `envconfig:"POSTGRES_URL"`
+	// The first upstream is the source of truth, the rest are peer
+	// mirrors that are used only when it's unavailable.
+	Upstream []string `default:"https://plc.directory"`
+	LockID   int64    `default:"6515824"`
+
+	// If enabled, signatures and CIDs of all operations are verified
+	// before storing them.
+	VerifyOperations bool `split_words:"true"`
+	// If enabled, after catching up new operations are received over
+	// the /export/stream websocket instead of polling /export.
+	UseExportStream bool `split_words:"true"`
+
+	// LeaderElection is either "advisory_lock" or "lease". Advisory lock
+	// needs a session-level connection, so it doesn't work behind
+	// PgBouncer in transaction mode.
+	LeaderElection string        `split_words:"true" default:"advisory_lock"`
+	LeaseDuration  time.Duration `split_words:"true" default:"1m"`
+
+	// Number of rendered DID documents to keep in memory. 0 disables
+	// the cache.
+	DocumentCacheSize int `split_words:"true" default:"100000"`
+	// max-age to send in Cache-Control header of per-DID responses.
+	CacheMaxAge time.Duration `split_words:"true"`
+	// StaleMode is either "strict" (respond with 503 when the mirror is
+	// behind) or "serve" (respond from the local data anyway).
+	StaleMode string `split_words:"true" default:"strict"`
+
+	// If enabled, requests for DIDs that are not found locally, or
+	// received while the mirror is behind, are forwarded to the first
+	// upstream.
+	ReadThrough bool `split_words:"true"`
+	// Maximum number of forwarded requests per second.
+	ReadThroughRateLimit float64 `split_words:"true" default:"10"`
 
 	// Default LockID value:
 	// ASCII "plc" -> 0x70 0x6c 0x63 -> ntohs() -> 0x636c70 -> 6515824
@@ -51,43 +89,12 @@ func runMain(ctx context.Context) error {
 	ctx = setupLogging(ctx)
 	log := zerolog.Ctx(ctx)
 	log.Debug().Msgf("Starting up...")
-	dbCfg, err := pgxpool.ParseConfig(config.DBUrl)
-	if err != nil {
-		return fmt.Errorf("parsing DB URL: %w", err)
-	}
-	dbCfg.MaxConns = 8
-	dbCfg.MinConns = 3
-	dbCfg.MaxConnLifetime = 6 * time.Hour
-	conn, err := pgxpool.NewWithConfig(ctx, dbCfg)
-	if err != nil {
-		return fmt.Errorf("connecting to postgres: %w", err)
-	}
-
-	sqldb := stdlib.OpenDBFromPool(conn)
-
-	gormDB, err := gorm.Open(postgres.New(postgres.Config{
-		Conn: sqldb,
-	}), &gorm.Config{
-		Logger: gormzerolog.New(&logger.Config{
-			SlowThreshold:             1 * time.Second,
-			IgnoreRecordNotFoundError: true,
-		}, nil),
-	})
-	if err != nil {
-		return fmt.Errorf("connecting to the database: %w", err)
-	}
-	log.Debug().Msgf("DB connection established")
-
-	db, err := schema.DetectVersion(ctx, gormDB)
+	db, leaderLock, pool, err := openDatabase(ctx)
 	if err != nil {
 		return err
 	}
 
-	leaderLock, err := pglock.New(conn, config.LockID)
-	if err != nil {
-		return fmt.Errorf("failed to create leader lock: %w", err)
-	}
-	mirror, err := NewMirror(ctx, config, db)
+	mirror, err := NewMirror(ctx, config, db, pool)
 	if err != nil {
 		return fmt.Errorf("failed to create mirroring worker: %w", err)
 	}
@@ -95,10 +102,24 @@ func runMain(ctx context.Context) error {
 		return fmt.Errorf("failed to start mirroring worker: %w", err)
 	}
 
-	server, err := NewServer(ctx, db, mirror)
+	server, err := NewServer(ctx, db, mirror, config.DocumentCacheSize)
 	if err != nil {
 		return fmt.Errorf("failed to create server: %w", err)
 	}
+	server.CacheMaxAge = config.CacheMaxAge
+	switch config.StaleMode {
+	case "strict":
+	case "serve":
+		server.ServeStale = true
+	default:
+		return fmt.Errorf("unknown stale mode %q", config.StaleMode)
+	}
+	if config.ReadThrough {
+		err := server.EnableReadThrough(config.Upstream[0], rate.Limit(config.ReadThroughRateLimit))
+		if err != nil {
+			return fmt.Errorf("enabling read-through: %w", err)
+		}
+	}
 	http.Handle("/", server)
 	http.HandleFunc("/ready", server.Ready)
 
@@ -118,6 +139,109 @@ func runMain(ctx context.Context) error {
 	return <-errCh
 }
 
+func newGormConfig() *gorm.Config {
+	return &gorm.Config{
+		Logger: gormzerolog.New(&logger.Config{
+			SlowThreshold:             1 * time.Second,
+			IgnoreRecordNotFoundError: true,
+		}, nil),
+	}
+}
+
+// openDatabase connects to the database specified in the config. URLs with
+// "sqlite:" and "bolt:" schemes point to a local SQLite or bbolt database
+// file, anything else is treated as a PostgreSQL connection string.
+// Returned connection pool is nil if the database is not PostgreSQL.
+func openDatabase(ctx context.Context) (schema.Database, leader.Elector, *pgxpool.Pool, error) {
+	log := zerolog.Ctx(ctx)
+
+	gormConfig := newGormConfig()
+
+	if path, ok := strings.CutPrefix(config.DBUrl, "sqlite:"); ok {
+		path = strings.TrimPrefix(path, "//")
+		gormDB, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", path)), gormConfig)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("opening SQLite database: %w", err)
+		}
+		log.Debug().Msgf("Opened SQLite database %q", path)
+
+		// Table layout is the same as in schema v1.
+		db := v1.New(gormDB)
+		if err := db.AutoMigrate(); err != nil {
+			return nil, nil, nil, fmt.Errorf("auto-migrating DB schema: %w", err)
+		}
+		// SQLite is used only with a single process, so there's
+		// nobody to elect.
+		return db, leader.Noop{}, nil, nil
+	}
+
+	if path, ok := strings.CutPrefix(config.DBUrl, "bolt:"); ok {
+		path = strings.TrimPrefix(path, "//")
+		db, err := kv.Open(path)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("opening bbolt database: %w", err)
+		}
+		log.Debug().Msgf("Opened bbolt database %q", path)
+
+		if err := db.AutoMigrate(); err != nil {
+			return nil, nil, nil, fmt.Errorf("auto-migrating DB schema: %w", err)
+		}
+		// bbolt file can't be opened by more than one process anyway.
+		return db, leader.Noop{}, nil, nil
+	}
+
+	conn, gormDB, err := openPostgres(ctx, gormConfig)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	db, err := schema.DetectVersion(ctx, gormDB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var leaderLock leader.Elector
+	switch config.LeaderElection {
+	case "advisory_lock":
+		leaderLock, err = pglock.New(conn, config.LockID)
+	case "lease":
+		leaderLock, err = leader.NewLease(ctx, conn, config.LockID, config.LeaseDuration)
+	default:
+		err = fmt.Errorf("unknown leader election method %q", config.LeaderElection)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create leader lock: %w", err)
+	}
+	return db, leaderLock, conn, nil
+}
+
+func openPostgres(ctx context.Context, gormConfig *gorm.Config) (*pgxpool.Pool, *gorm.DB, error) {
+	log := zerolog.Ctx(ctx)
+
+	dbCfg, err := pgxpool.ParseConfig(config.DBUrl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing DB URL: %w", err)
+	}
+	dbCfg.MaxConns = 8
+	dbCfg.MinConns = 3
+	dbCfg.MaxConnLifetime = 6 * time.Hour
+	conn, err := pgxpool.NewWithConfig(ctx, dbCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+
+	sqldb := stdlib.OpenDBFromPool(conn)
+
+	gormDB, err := gorm.Open(postgres.New(postgres.Config{
+		Conn: sqldb,
+	}), gormConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to the database: %w", err)
+	}
+	log.Debug().Msgf("DB connection established")
+	return conn, gormDB, nil
+}
+
 func main() {
 	flag.StringVar(&config.LogFile, "log", "", "Path to the log file. If empty, will log to stderr")
 	flag.StringVar(&config.LogFormat, "log-format", "text", "Logging format. 'text' or 'json'")
@@ -130,7 +254,15 @@ func main() {
 	flag.Parse()
 
 	ctx, _ := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	if err := runMain(ctx); err != nil {
+	run := runMain
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		run = runMigrate
+	default:
+		log.Fatalf("Unknown command %q", flag.Arg(0))
+	}
+	if err := run(ctx); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
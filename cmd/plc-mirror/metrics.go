@@ -20,3 +20,38 @@ var requestLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Help:    "Latency of responses.",
 	Buckets: prometheus.ExponentialBucketsRange(0.1, 30000, 20),
 }, []string{"status"})
+
+var verificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "plcmirror_verification_failures_total",
+	Help: "Counter of operations received from upstream that failed verification.",
+}, []string{"reason"})
+
+var upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plcmirror_upstream_healthy",
+	Help: "Whether the last request to the upstream was successful.",
+}, []string{"upstream"})
+
+var upstreamConsistent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "plcmirror_upstream_consistent",
+	Help: "Whether the peer upstream has passed the last consistency check.",
+}, []string{"upstream"})
+
+var upstreamFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "plcmirror_upstream_failures_total",
+	Help: "Counter of failed requests to upstreams, by the type of failure.",
+}, []string{"upstream", "class"})
+
+var documentCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "plcmirror_document_cache_requests_total",
+	Help: "Counter of DID document cache lookups, by result.",
+}, []string{"result"})
+
+var mirrorStaleness = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "plcmirror_staleness_seconds",
+	Help: "Time since the mirror was last known to be up to date with upstream.",
+})
+
+var readThroughRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "plcmirror_read_through_requests_total",
+	Help: "Counter of requests proxied to upstream, by result.",
+}, []string{"result"})
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"bsky.watch/plc-mirror/schema"
+	"bsky.watch/plc-mirror/util/pglock"
+)
+
+// runMigrate implements the `migrate` command, that copies data from
+// schema v1 into schema v2.
+func runMigrate(ctx context.Context) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	batchSize := flags.Int("batch-size", 1000, "Number of DIDs to copy at once")
+	flags.Parse(flag.Args()[1:])
+
+	ctx = setupLogging(ctx)
+
+	conn, gormDB, err := openPostgres(ctx, newGormConfig())
+	if err != nil {
+		return err
+	}
+
+	// Prevent multiple migrations from running at the same time. Lock ID
+	// is different from the one used for leader election, so the mirror
+	// can keep running.
+	lock, err := pglock.New(conn, config.LockID+1)
+	if err != nil {
+		return fmt.Errorf("failed to create migration lock: %w", err)
+	}
+	ok, err := lock.TryLock(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("another migration is already running")
+	}
+	defer lock.Unlock(context.Background())
+
+	return schema.MigrateV1ToV2(ctx, gormDB, *batchSize)
+}
@@ -2,22 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"math"
+	"maps"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog"
 	"golang.org/x/time/rate"
 	"gorm.io/gorm"
 
 	"bsky.watch/plc-mirror/schema"
-	"bsky.watch/plc-mirror/util/pglock"
+	"bsky.watch/plc-mirror/util/leader"
 	"bsky.watch/plc-mirror/util/plc"
 )
 
@@ -26,44 +27,93 @@ const (
 	defaultRateLimit  = rate.Limit(450.0 / 300)
 	caughtUpRateLimit = rate.Limit(0.2)
 	caughtUpThreshold = 10 * time.Minute
+
+	// lastCompletionPersistInterval limits how often the last completion
+	// time is written to the database, since the stream updates it
+	// on every flush.
+	lastCompletionPersistInterval = 10 * time.Second
+
+	// cooldownCheckInterval is how often the leader renews its lease while
+	// waiting for upstreams to come out of cooldown. Must be well below
+	// the lease duration.
+	cooldownCheckInterval = 10 * time.Second
 )
 
 type Mirror struct {
-	db       schema.Database
-	dbUrl    string
-	upstream *url.URL
-	limiter  *rate.Limiter
-	lockID   int64
+	db        schema.Database
+	dbUrl     string
+	upstreams []*upstream
+	lockID    int64
+	ingester  *ingester
+
+	// reference is the last page received from a trusted upstream.
+	reference *pageSample
+
+	// streamURL is nil if the export stream is disabled.
+	streamURL     *url.URL
+	streamRetryAt time.Time
+
+	// pool is used for notifying other replicas about updates. It's nil
+	// if the database is not Postgres.
+	pool *pgxpool.Pool
+
+	headRefresh chan struct{}
 
 	mu                      sync.RWMutex
 	lastCompletionTimestamp time.Time
+	lastCompletionPersisted time.Time
+	updateSubscribers       []func(dids []string)
+	// In-memory copies of the values stored in the database, see
+	// refreshHead.
+	headTimestamp        time.Time
+	sharedLastCompletion time.Time
 }
 
-func NewMirror(ctx context.Context, cfg Config, db schema.Database) (*Mirror, error) {
-	u, err := url.Parse(cfg.Upstream)
-	if err != nil {
-		return nil, err
-	}
-	u.Path, err = url.JoinPath(u.Path, "export")
-	if err != nil {
-		return nil, err
+func NewMirror(ctx context.Context, cfg Config, db schema.Database, pool *pgxpool.Pool) (*Mirror, error) {
+	if len(cfg.Upstream) == 0 {
+		return nil, fmt.Errorf("no upstreams specified")
 	}
 	r := &Mirror{
 		db:       db,
-		upstream: u,
-		limiter:  rate.NewLimiter(defaultRateLimit, 4),
 		lockID:   cfg.LockID,
 		dbUrl:    cfg.DBUrl,
+		ingester: &ingester{db: db, verify: cfg.VerifyOperations},
+		pool:     pool,
+
+		headRefresh: make(chan struct{}, 1),
+	}
+	for i, s := range cfg.Upstream {
+		// The first one is the source of truth, the rest are peers.
+		up, err := newUpstream(s, i == 0)
+		if err != nil {
+			return nil, fmt.Errorf("parsing upstream URL %q: %w", s, err)
+		}
+		r.upstreams = append(r.upstreams, up)
+	}
+	if cfg.UseExportStream {
+		var err error
+		r.streamURL, err = streamURL(r.upstreams[0].exportURL)
+		if err != nil {
+			return nil, fmt.Errorf("constructing export stream URL: %w", err)
+		}
 	}
 	return r, nil
 }
 
-func (m *Mirror) Start(ctx context.Context, leaderLock *pglock.Lock) error {
+func (m *Mirror) Start(ctx context.Context, leaderLock leader.Elector) error {
+	if err := m.refreshHead(ctx); err != nil {
+		// Not fatal, it'll be retried by trackHead.
+		zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to get head timestamp: %s", err)
+	}
+	go m.trackHead(ctx)
+	if m.pool != nil {
+		go m.listenForUpdates(ctx)
+	}
 	go m.run(ctx, leaderLock)
 	return nil
 }
 
-func (m *Mirror) run(ctx context.Context, leaderLock *pglock.Lock) {
+func (m *Mirror) run(ctx context.Context, leaderLock leader.Elector) {
 	log := zerolog.Ctx(ctx).With().Str("module", "mirror").Logger()
 	for {
 		select {
@@ -100,11 +150,23 @@ func (m *Mirror) run(ctx context.Context, leaderLock *pglock.Lock) {
 					if ctx.Err() == nil {
 						log.Error().Err(err).Msgf("Failed to get new log entries from PLC: %s", err)
 					}
+					// Don't retry until at least one upstream is out of cooldown.
+					m.waitForCooldown(ctx, leaderLock)
 				} else {
-					now := time.Now()
-					m.mu.Lock()
-					m.lastCompletionTimestamp = now
-					m.mu.Unlock()
+					m.setLastCompletion(ctx, time.Now())
+
+					if m.streamURL != nil && time.Now().After(m.streamRetryAt) {
+						// We're caught up, switch to the stream.
+						err := m.runStream(ctx, leaderLock)
+						switch {
+						case ctx.Err() != nil:
+						case errors.Is(err, errNotLeader):
+							log.Warn().Msgf("Lost leadership status")
+						case err != nil:
+							log.Error().Err(err).Msgf("Export stream failed, falling back to polling: %s", err)
+							m.streamRetryAt = time.Now().Add(streamRetryInterval)
+						}
+					}
 				}
 				time.Sleep(10 * time.Second)
 			}
@@ -112,22 +174,35 @@ func (m *Mirror) run(ctx context.Context, leaderLock *pglock.Lock) {
 	}
 }
 
-func (m *Mirror) LastCompletion() time.Time {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.lastCompletionTimestamp
+// nextAttempt returns the earliest time when any of the upstreams
+// can be used again.
+func (m *Mirror) nextAttempt() time.Time {
+	r := m.upstreams[0].availableAt()
+	for _, up := range m.upstreams[1:] {
+		if t := up.availableAt(); t.Before(r) {
+			r = t
+		}
+	}
+	return r
 }
 
-func (m *Mirror) LastRecordTimestamp(ctx context.Context) (time.Time, error) {
-	ts, err := m.db.HeadTimestamp(ctx)
-	if err != nil {
-		return time.Time{}, err
+// setLastCompletion records the time of the last successful poll. It's also
+// stored in the database, so that non-leader replicas know that we're
+// caught up even if there are no new operations.
+func (m *Mirror) setLastCompletion(ctx context.Context, t time.Time) {
+	m.mu.Lock()
+	m.lastCompletionTimestamp = t
+	persist := t.Sub(m.lastCompletionPersisted) >= lastCompletionPersistInterval
+	if persist {
+		m.lastCompletionPersisted = t
 	}
-	dbTimestamp, err := time.Parse(time.RFC3339, ts)
-	if err != nil {
-		return time.Time{}, fmt.Errorf("parsing timestamp %q: %w", ts, err)
+	m.mu.Unlock()
+
+	if persist {
+		if err := m.db.SetLastCompletion(ctx, t); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to store last completion time: %s", err)
+		}
 	}
-	return dbTimestamp, nil
 }
 
 func (m *Mirror) updateRateLimit(lastRecordTimestamp time.Time) {
@@ -136,12 +211,33 @@ func (m *Mirror) updateRateLimit(lastRecordTimestamp time.Time) {
 	if time.Since(lastRecordTimestamp) < caughtUpThreshold {
 		desiredRate = caughtUpRateLimit
 	}
-	if math.Abs(float64(m.limiter.Limit()-desiredRate)) > 0.0000001 {
-		m.limiter.SetLimit(rate.Limit(desiredRate))
+	for _, up := range m.upstreams {
+		up.updateRateLimit(desiredRate)
+	}
+}
+
+// waitForCooldown sleeps until at least one upstream is out of cooldown,
+// renewing the leader lease in the meantime, so that it doesn't expire
+// and get taken over by another replica that will hit the same upstreams.
+func (m *Mirror) waitForCooldown(ctx context.Context, leaderLock leader.Elector) {
+	for {
+		d := time.Until(m.nextAttempt())
+		if d <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(min(d, cooldownCheckInterval)):
+		}
+		if isLeader, err := leaderLock.Check(ctx); err != nil || !isLeader {
+			// Let the main loop deal with it.
+			return
+		}
 	}
 }
 
-func (m *Mirror) runOnce(ctx context.Context, leaderLock *pglock.Lock) error {
+func (m *Mirror) runOnce(ctx context.Context, leaderLock leader.Elector) error {
 	log := zerolog.Ctx(ctx)
 
 	cursor, err := m.db.HeadTimestamp(ctx)
@@ -160,52 +256,61 @@ func (m *Mirror) runOnce(ctx context.Context, leaderLock *pglock.Lock) error {
 		}
 	}
 
-	u := *m.upstream
+	// Prefer sequence numbers if upstream provides them: unlike timestamps
+	// they are unique, so nothing can get skipped or duplicated at page
+	// boundaries.
+	seq, err := m.db.HeadSeq(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the sequence number cursor: %w", err)
+	}
+	var lastErr error
 
 	for {
-		params := u.Query()
-		params.Set("count", "1000")
-		if cursor != "" {
-			params.Set("after", cursor)
+		// Re-evaluated on every iteration, so that we switch back to
+		// the authoritative upstream as soon as it's available again.
+		up := m.pickUpstream(ctx, cursor)
+		if up == nil {
+			return fmt.Errorf("no healthy upstreams available, last error: %w", lastErr)
 		}
-		u.RawQuery = params.Encode()
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-		if err != nil {
-			return fmt.Errorf("constructing request: %w", err)
+		useSeq := seq > 0 && !up.seqCursorUnsupported
+		currentCursor := cursor
+		if useSeq {
+			currentCursor = strconv.FormatInt(seq, 10)
 		}
 
-		_ = m.limiter.Wait(ctx)
-		log.Info().Msgf("Listing PLC log entries with cursor %q...", cursor)
-		log.Debug().Msgf("Request URL: %s", u.String())
-		resp, err := http.DefaultClient.Do(req)
+		log.Info().Str("upstream", up.String()).Msgf("Listing PLC log entries from %q with cursor %q...", up, currentCursor)
+		newEntries, err := up.fetchPage(ctx, currentCursor, 1000)
 		if err != nil {
-			return fmt.Errorf("sending request: %w", err)
+			var statusErr *statusError
+			if errors.As(err, &statusErr) && statusErr.code == http.StatusBadRequest && useSeq {
+				log.Warn().Msgf("Upstream %q doesn't support sequence number cursors, falling back to timestamps", up)
+				up.seqCursorUnsupported = true
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Warn().Err(err).Str("upstream", up.String()).Msgf("Failed to get log entries from %q: %s", up, err)
+			up.markFailure(err)
+			lastErr = err
+			continue
 		}
+		up.markSuccess()
 
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		if len(newEntries) == 0 {
+			break
 		}
 
-		newEntries := []plc.OperationLogEntry{}
-		decoder := json.NewDecoder(resp.Body)
-		oldCursor := cursor
+		if useSeq && newEntries[0].Seq <= seq {
+			// Upstream has interpreted our cursor as something else.
+			log.Warn().Msgf("Upstream %q doesn't support sequence number cursors, falling back to timestamps", up)
+			up.seqCursorUnsupported = true
+			continue
+		}
 
 		var lastTimestamp time.Time
-
-		for {
-			var entry plc.OperationLogEntry
-			err := decoder.Decode(&entry)
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("parsing log entry: %w", err)
-			}
-
-			newEntries = append(newEntries, entry)
-
+		for _, entry := range newEntries {
 			t, err := time.Parse(time.RFC3339, entry.CreatedAt)
 			if err == nil {
 				lastEventTimestamp.Set(float64(t.Unix()))
@@ -215,35 +320,101 @@ func (m *Mirror) runOnce(ctx context.Context, leaderLock *pglock.Lock) error {
 			}
 		}
 
-		if len(newEntries) == 0 {
-			break
-		}
-
+		oldCursor := cursor
+		oldSeq := seq
 		cursor = plc.NextCursor(newEntries)
-		if cursor == oldCursor {
+		seq = plc.NextSeqCursor(newEntries)
+		if cursor == oldCursor && seq == oldSeq {
 			// Shouldn't happen
 			break
 		}
 
-		isLeader, err := leaderLock.Check(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to check leadership status: %w", err)
+		if up.authoritative || up.verified() {
+			// Keep both cursors, peers might not support
+			// sequence numbers.
+			refSeq := int64(0)
+			if useSeq {
+				refSeq = oldSeq
+			}
+			m.reference = sampleOf(oldCursor, refSeq, newEntries)
 		}
-		if !isLeader {
+
+		newEntries, err = m.storeEntries(ctx, leaderLock, newEntries)
+		if errors.Is(err, errNotLeader) {
 			log.Warn().Msgf("Lost leadership status")
 			return nil
 		}
-
-		err = m.db.AppendEntries(ctx, newEntries)
 		if err != nil {
-			return fmt.Errorf("inserting log entry into database: %w", err)
+			return err
 		}
 
 		if !lastTimestamp.IsZero() {
 			m.updateRateLimit(lastTimestamp)
 		}
 
-		log.Info().Msgf("Got %d log entries. New cursor: %q", len(newEntries), cursor)
+		if seq > 0 && !up.seqCursorUnsupported {
+			log.Info().Msgf("Got %d log entries. New cursor: %d", len(newEntries), seq)
+		} else {
+			log.Info().Msgf("Got %d log entries. New cursor: %q", len(newEntries), cursor)
+		}
 	}
 	return nil
 }
+
+var errNotLeader = errors.New("not a leader")
+
+// storeEntries processes and stores a batch of new entries received from
+// upstream. Returns entries that were actually stored.
+func (m *Mirror) storeEntries(ctx context.Context, leaderLock leader.Elector, entries []plc.OperationLogEntry) ([]plc.OperationLogEntry, error) {
+	isLeader, err := leaderLock.Check(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check leadership status: %w", err)
+	}
+	if !isLeader {
+		return nil, errNotLeader
+	}
+	// Make sure that nothing gets written if another replica takes over
+	// while we're processing this batch.
+	ctx = leaderLock.Fence(ctx)
+
+	entries = checkGenesisDIDs(ctx, entries)
+	entries, nullified, err := m.ingester.Process(ctx, entries)
+	if err != nil {
+		return nil, fmt.Errorf("processing log entries: %w", err)
+	}
+
+	// Nullification needs to happen first: if we crash before appending
+	// new entries, they will be re-fetched and the result will
+	// still be correct.
+	if len(nullified) > 0 {
+		err = m.db.NullifyEntries(ctx, nullified)
+		if errors.Is(err, leader.ErrStaleLeader) {
+			return nil, errNotLeader
+		}
+		if err != nil {
+			return nil, fmt.Errorf("marking log entries as nullified: %w", err)
+		}
+	}
+
+	if len(entries) > 0 {
+		err = m.db.AppendEntries(ctx, entries)
+		if errors.Is(err, leader.ErrStaleLeader) {
+			return nil, errNotLeader
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inserting log entry into database: %w", err)
+		}
+	}
+
+	updated := slices.Collect(maps.Keys(nullified))
+	for _, entry := range entries {
+		updated = append(updated, entry.DID)
+	}
+	slices.Sort(updated)
+	m.notifyUpdated(ctx, slices.Compact(updated))
+
+	if t, err := time.Parse(time.RFC3339, plc.NextCursor(entries)); err == nil {
+		m.advanceHead(t)
+	}
+	return entries, nil
+}
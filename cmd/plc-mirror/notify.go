@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// updatesChannel is the Postgres NOTIFY channel used by the leader to
+	// tell other replicas which DIDs have changed.
+	updatesChannel = "plc_mirror_updates"
+	// Notification payload must be shorter than 8000 bytes.
+	didsPerNotification = 200
+)
+
+// OnUpdate registers a function that is called with DIDs whose logs have
+// been changed, either by this replica or, with Postgres, by the leader.
+// nil means that any DID might have changed, e.g. because some
+// notifications could have been missed.
+func (m *Mirror) OnUpdate(fn func(dids []string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateSubscribers = append(m.updateSubscribers, fn)
+}
+
+func (m *Mirror) dispatchUpdate(dids []string) {
+	m.mu.RLock()
+	subscribers := m.updateSubscribers
+	m.mu.RUnlock()
+	for _, fn := range subscribers {
+		fn(dids)
+	}
+}
+
+// notifyUpdated is called after storing changes to the logs of `dids`.
+func (m *Mirror) notifyUpdated(ctx context.Context, dids []string) {
+	if len(dids) == 0 {
+		return
+	}
+	m.dispatchUpdate(dids)
+
+	if m.pool == nil {
+		return
+	}
+	for len(dids) > 0 {
+		n := min(didsPerNotification, len(dids))
+		_, err := m.pool.Exec(ctx, "select pg_notify($1, $2)", updatesChannel, strings.Join(dids[:n], ","))
+		if err != nil {
+			// Replicas will still pick up the change once
+			// the cached entries expire.
+			zerolog.Ctx(ctx).Error().Err(err).Msgf("Failed to notify other replicas about updated DIDs: %s", err)
+			return
+		}
+		dids = dids[n:]
+	}
+}
+
+// listenForUpdates receives notifications sent by notifyUpdated on
+// the leader and dispatches them to local subscribers.
+func (m *Mirror) listenForUpdates(ctx context.Context) {
+	log := zerolog.Ctx(ctx).With().Str("module", "notify").Logger()
+	for {
+		err := m.listenOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error().Err(err).Msgf("Listening for updates failed: %s", err)
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (m *Mirror) listenOnce(ctx context.Context) error {
+	c, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquiring a connection: %w", err)
+	}
+	// The connection stays subscribed to the channel, so it must not be
+	// returned to the pool.
+	conn := c.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "listen "+updatesChannel); err != nil {
+		return fmt.Errorf("subscribing to notifications: %w", err)
+	}
+	// Anything could've changed while we weren't listening.
+	m.dispatchUpdate(nil)
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("waiting for notification: %w", err)
+		}
+		if n.Payload == "" {
+			continue
+		}
+		m.dispatchUpdate(strings.Split(n.Payload, ","))
+		m.requestHeadRefresh()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/rs/zerolog"
+
+	"bsky.watch/plc-mirror/schema"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+
+	// Counting requires a full scan, so the result is reused for a while.
+	pdsCountsCacheTTL = 5 * time.Minute
+)
+
+// pdsQueryResult is the format of the /_query/pds response.
+type pdsQueryResult struct {
+	Host   string   `json:"host"`
+	DIDs   []string `json:"dids"`
+	Cursor string   `json:"cursor,omitempty"`
+}
+
+type pdsCount struct {
+	Host  string `json:"host"`
+	Count int64  `json:"count"`
+}
+
+// pdsCountsCache holds the last result of PDSHostCounts.
+type pdsCountsCache struct {
+	mu        sync.Mutex
+	counts    []pdsCount
+	fetchedAt time.Time
+}
+
+func (s *Server) pdsIndex(updateMetrics func(int)) (schema.PDSIndex, convreq.HttpResponse) {
+	index, ok := s.db.(schema.PDSIndex)
+	if !ok {
+		updateMetrics(http.StatusNotImplemented)
+		return nil, respond.NotImplemented("PDS queries are not supported by the current database schema")
+	}
+	return index, nil
+}
+
+// servePDSQuery lists DIDs that currently use a given PDS host, with
+// pagination: pass `cursor` from the previous response to get
+// the next page.
+func (s *Server) servePDSQuery(ctx context.Context, req *http.Request, updateMetrics func(int)) convreq.HttpResponse {
+	log := zerolog.Ctx(ctx)
+
+	index, resp := s.pdsIndex(updateMetrics)
+	if resp != nil {
+		return resp
+	}
+
+	params := req.URL.Query()
+	host := params.Get("host")
+	if strings.Contains(host, "://") {
+		// Accept full endpoint URLs too.
+		if u, err := url.Parse(host); err == nil {
+			host = u.Hostname()
+		}
+	}
+	if host == "" {
+		updateMetrics(http.StatusBadRequest)
+		return respond.BadRequest("'host' parameter is required")
+	}
+	limit := defaultQueryLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			updateMetrics(http.StatusBadRequest)
+			return respond.BadRequest("invalid limit")
+		}
+		limit = min(n, maxQueryLimit)
+	}
+
+	dids, err := index.DIDsByPDSHost(ctx, host, params.Get("cursor"), limit)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to list DIDs on %q: %s", host, err)
+		updateMetrics(http.StatusInternalServerError)
+		return respond.InternalServerError("failed to list DIDs")
+	}
+
+	r := pdsQueryResult{Host: strings.ToLower(host), DIDs: dids}
+	if len(dids) == limit {
+		r.Cursor = dids[len(dids)-1]
+	}
+	updateMetrics(http.StatusOK)
+	return respond.JSON(r)
+}
+
+// servePDSCounts returns the number of DIDs on each PDS host, sorted
+// by the number of DIDs.
+func (s *Server) servePDSCounts(ctx context.Context, updateMetrics func(int)) convreq.HttpResponse {
+	log := zerolog.Ctx(ctx)
+
+	index, resp := s.pdsIndex(updateMetrics)
+	if resp != nil {
+		return resp
+	}
+
+	s.pdsCounts.mu.Lock()
+	defer s.pdsCounts.mu.Unlock()
+
+	if time.Since(s.pdsCounts.fetchedAt) > pdsCountsCacheTTL {
+		counts, err := index.PDSHostCounts(ctx)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to count DIDs per PDS: %s", err)
+			updateMetrics(http.StatusInternalServerError)
+			return respond.InternalServerError("failed to count DIDs")
+		}
+
+		r := make([]pdsCount, 0, len(counts))
+		for host, count := range counts {
+			r = append(r, pdsCount{Host: host, Count: count})
+		}
+		slices.SortFunc(r, func(a, b pdsCount) int {
+			return cmp.Or(-cmp.Compare(a.Count, b.Count), cmp.Compare(a.Host, b.Host))
+		})
+		s.pdsCounts.counts = r
+		s.pdsCounts.fetchedAt = time.Now()
+	}
+
+	updateMetrics(http.StatusOK)
+	return respond.JSON(s.pdsCounts.counts)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+)
+
+const (
+	readThroughTimeout = 10 * time.Second
+	// Responses for a single DID are small, anything larger is
+	// most likely an error.
+	maxProxiedResponseSize = 1 << 20
+)
+
+// readThrough fetches responses from upstream for requests that can't be
+// answered locally.
+type readThrough struct {
+	baseURL *url.URL
+	limiter *rate.Limiter
+}
+
+// EnableReadThrough makes the server fetch per-DID responses from
+// `upstream` if the DID is not found locally or the mirror is behind.
+func (s *Server) EnableReadThrough(upstream string, limit rate.Limit) error {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return fmt.Errorf("parsing upstream URL %q: %w", upstream, err)
+	}
+	s.readThrough = &readThrough{
+		baseURL: u,
+		limiter: rate.NewLimiter(limit, max(1, int(limit))),
+	}
+	return nil
+}
+
+type proxyAttemptedKey struct{}
+
+// withProxyAttempted marks the request as already having had its chance
+// to be served from upstream, so that proxy doesn't try again.
+func withProxyAttempted(ctx context.Context) context.Context {
+	return context.WithValue(ctx, proxyAttemptedKey{}, true)
+}
+
+// proxy fetches the response for `req` from upstream. It returns nil if
+// read-through is disabled or the upstream response can't be used,
+// in which case the caller should respond from the local data.
+// Upstream is asked at most once per request: if the mirror is behind,
+// before looking at the local data, otherwise on a local miss.
+func (s *Server) proxy(ctx context.Context, req *http.Request, updateMetrics func(int)) convreq.HttpResponse {
+	log := zerolog.Ctx(ctx)
+
+	rt := s.readThrough
+	// Upstream doesn't support historical queries.
+	if rt == nil || req.URL.Query().Get("at") != "" || ctx.Value(proxyAttemptedKey{}) != nil {
+		return nil
+	}
+	if !rt.limiter.Allow() {
+		readThroughRequests.WithLabelValues("throttled").Inc()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readThroughTimeout)
+	defer cancel()
+
+	reqURL := rt.baseURL.JoinPath(req.URL.Path)
+	upReq, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to construct upstream request: %s", err)
+		return nil
+	}
+	resp, err := http.DefaultClient.Do(upReq)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to fetch %q from upstream: %s", reqURL, err)
+		readThroughRequests.WithLabelValues("error").Inc()
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Includes 404 for DIDs that don't exist upstream either. Local
+		// response will be the same, or at least consistent with
+		// our other responses.
+		readThroughRequests.WithLabelValues("error").Inc()
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxProxiedResponseSize+1))
+	if err != nil || len(body) > maxProxiedResponseSize {
+		log.Warn().Err(err).Msgf("Failed to read response for %q from upstream", reqURL)
+		readThroughRequests.WithLabelValues("error").Inc()
+		return nil
+	}
+	readThroughRequests.WithLabelValues("ok").Inc()
+
+	headers := http.Header{}
+	headers.Set("Content-Type", resp.Header.Get("Content-Type"))
+	// Upstream responses can't be revalidated against local data.
+	headers.Set("Cache-Control", "no-cache")
+	headers.Set("X-PLC-Mirror-Source", "upstream")
+	updateMetrics(http.StatusOK)
+	return respond.WithHeaders(respond.Bytes(body), headers)
+}
+
+// isDIDPath returns true for paths that contain a DID followed by
+// an optional subpath.
+func isDIDPath(path string) bool {
+	return strings.HasPrefix(path, "/did:")
+}
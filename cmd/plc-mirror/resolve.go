@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Jille/convreq"
+	"github.com/Jille/convreq/respond"
+	"github.com/nuts-foundation/go-did/did"
+	"github.com/rs/zerolog"
+
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+const (
+	maxBatchSize = 1000
+	// Enough for maxBatchSize DIDs, with some room for whitespace.
+	maxBatchBodySize = 64 * 1024
+)
+
+// batchRequest is the format of the /_resolve request body.
+type batchRequest struct {
+	DIDs []string `json:"dids"`
+}
+
+// batchResult is the per-DID part of the /_resolve response. Exactly
+// one of Document and Error is set.
+type batchResult struct {
+	Document *did.Document `json:"document,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Status   int           `json:"status"`
+}
+
+// serveBatchResolve returns DID documents for multiple DIDs at once.
+// Response maps each requested DID (lowercased) to either a document or
+// an error with the status code that a single-DID request would've got.
+func (s *Server) serveBatchResolve(ctx context.Context, req *http.Request, updateMetrics func(int)) convreq.HttpResponse {
+	log := zerolog.Ctx(ctx)
+
+	if req.Method != http.MethodPost {
+		updateMetrics(http.StatusMethodNotAllowed)
+		return respond.MethodNotAllowed("only POST is supported")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBatchBodySize+1))
+	if err != nil {
+		updateMetrics(http.StatusBadRequest)
+		return respond.BadRequest(fmt.Sprintf("failed to read request body: %s", err))
+	}
+	if len(body) > maxBatchBodySize {
+		updateMetrics(http.StatusRequestEntityTooLarge)
+		return respond.PayloadTooLarge(fmt.Sprintf("request body must not exceed %d bytes", maxBatchBodySize))
+	}
+	var params batchRequest
+	if err := json.Unmarshal(body, &params); err != nil {
+		updateMetrics(http.StatusBadRequest)
+		return respond.BadRequest(fmt.Sprintf("invalid request body: %s", err))
+	}
+	if len(params.DIDs) > maxBatchSize {
+		updateMetrics(http.StatusBadRequest)
+		return respond.BadRequest(fmt.Sprintf("at most %d DIDs can be requested at once", maxBatchSize))
+	}
+
+	r := map[string]batchResult{}
+	dids := []string{}
+	for _, d := range params.DIDs {
+		d = strings.ToLower(d)
+		if _, ok := r[d]; ok {
+			continue
+		}
+		if !strings.HasPrefix(d, "did:plc:") {
+			r[d] = batchResult{Error: "not a did:plc DID", Status: http.StatusBadRequest}
+			continue
+		}
+		r[d] = batchResult{Error: "unknown DID", Status: http.StatusNotFound}
+		dids = append(dids, d)
+	}
+
+	entries, err := s.db.LastOperationsForDIDs(ctx, dids)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to get the last log entries for %d DIDs: %s", len(dids), err)
+		updateMetrics(http.StatusInternalServerError)
+		return respond.InternalServerError("failed to get the last log entries")
+	}
+	for d, entry := range entries {
+		if _, ok := entry.Operation.Value.(plc.Tombstone); ok {
+			r[d] = batchResult{Error: "DID deleted", Status: http.StatusGone}
+			continue
+		}
+		doc := didDocument(entry)
+		r[d] = batchResult{Document: &doc, Status: http.StatusOK}
+	}
+
+	updateMetrics(http.StatusOK)
+	return respond.JSON(r)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,16 +29,31 @@ type Server struct {
 	mirror *Mirror
 
 	MaxDelay time.Duration
+	// CacheMaxAge is sent in Cache-Control header of responses for
+	// individual DIDs. Zero means that clients should always revalidate.
+	CacheMaxAge time.Duration
+	// If ServeStale is true, requests are served even if the mirror is
+	// more than MaxDelay behind, with a Warning header added, and all
+	// responses include the mirror's lag and head timestamp. Otherwise
+	// requests get 503 while the mirror is behind.
+	ServeStale bool
 
-	handler http.HandlerFunc
+	handler     http.HandlerFunc
+	pdsCounts   pdsCountsCache
+	docCache    *documentCache
+	readThrough *readThrough
 }
 
-func NewServer(ctx context.Context, db schema.Database, mirror *Mirror) (*Server, error) {
+// NewServer creates a server. `cacheSize` is the number of DID documents
+// to keep in memory, 0 disables caching.
+func NewServer(ctx context.Context, db schema.Database, mirror *Mirror, cacheSize int) (*Server, error) {
 	s := &Server{
 		db:       db,
 		mirror:   mirror,
 		MaxDelay: 5 * time.Minute,
+		docCache: newDocumentCache(cacheSize),
 	}
+	mirror.OnUpdate(s.docCache.Invalidate)
 	s.handler = convreq.Wrap(s.serve)
 	return s, nil
 }
@@ -48,18 +64,29 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 func (s *Server) Ready(w http.ResponseWriter, req *http.Request) {
 	convreq.Wrap(func(ctx context.Context) convreq.HttpResponse {
-		ts, err := s.mirror.LastRecordTimestamp(ctx)
-		if err != nil {
-			return respond.InternalServerError(err.Error())
-		}
-		delay := time.Since(ts)
-		if delay > s.MaxDelay {
+		delay, upToDate := s.upToDate()
+		if !upToDate {
 			return respond.ServiceUnavailable(fmt.Sprintf("still %s behind", delay))
 		}
 		return respond.String("OK")
 	})(w, req)
 }
 
+// upToDate checks if the mirror is caught up with upstream. Returned
+// delay is the age of the newest stored operation.
+func (s *Server) upToDate() (time.Duration, bool) {
+	delay := time.Since(s.mirror.LastRecordTimestamp())
+	if delay <= s.MaxDelay {
+		return delay, true
+	}
+
+	// Check LastCompletion and if it's recent enough - that means
+	// that we're actually caught up and there simply aren't any recent
+	// PLC operations. It's recorded in the database by the leader,
+	// so this works on all replicas.
+	return delay, time.Since(s.mirror.LastCompletion()) <= s.MaxDelay
+}
+
 func (s *Server) serve(ctx context.Context, req *http.Request) convreq.HttpResponse {
 	start := time.Now()
 	updateMetrics := func(c int) {
@@ -67,51 +94,174 @@ func (s *Server) serve(ctx context.Context, req *http.Request) convreq.HttpRespo
 		requestLatency.WithLabelValues(fmt.Sprint(c)).Observe(float64(time.Now().Sub(start)) / float64(time.Millisecond))
 	}
 
+	if req.URL.Path == "/export" {
+		// Exported entries are consistent even if we're behind, so we
+		// don't check the delay here. Clients will simply get
+		// fewer new entries.
+		return s.serveExport(ctx, req, updateMetrics)
+	}
+
 	// Check if the mirror is up to date.
-	ts, err := s.mirror.LastRecordTimestamp(ctx)
-	if err != nil {
-		return respond.InternalServerError(err.Error())
-	}
-	delay := time.Since(ts)
-	if delay > s.MaxDelay {
-		// Check LastCompletion and if it's recent enough - that means
-		// that we're actually caught up and there simply aren't any recent
-		// PLC operations.
-		//
-		// XXX: non-leader instances won't know LastCompletion and will start
-		// returning errors.
-		completionDelay := time.Since(s.mirror.LastCompletion())
-		if completionDelay > s.MaxDelay {
+	delay, upToDate := s.upToDate()
+	if !upToDate && isDIDPath(req.URL.Path) {
+		if resp := s.proxy(ctx, req, updateMetrics); resp != nil {
+			return resp
+		}
+		// Whatever the reason, don't ask upstream again if the DID
+		// is missing locally.
+		ctx = withProxyAttempted(ctx)
+	}
+	if !s.ServeStale {
+		if !upToDate {
 			updateMetrics(http.StatusServiceUnavailable)
 			return respond.ServiceUnavailable(fmt.Sprintf("mirror is %s behind", delay))
 		}
+		return s.route(ctx, req, updateMetrics)
 	}
-	log := zerolog.Ctx(ctx)
 
-	requestedDid := strings.ToLower(strings.TrimPrefix(req.URL.Path, "/"))
-	entry, err := s.db.LastOperationForDID(ctx, requestedDid)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
+	// Let clients decide for themselves if the data is fresh enough.
+	headers := http.Header{}
+	headers.Set("X-PLC-Mirror-Lag", strconv.Itoa(int(s.mirror.Staleness().Seconds())))
+	if head := s.mirror.LastRecordTimestamp(); !head.IsZero() {
+		headers.Set("X-PLC-Mirror-Head", plc.FormatTimestamp(head))
+	}
+	if !upToDate {
+		headers.Set("Warning", `110 - "Response is Stale"`)
+	}
+	return freshnessHeaders{parent: s.route(ctx, req, updateMetrics), headers: headers, stale: !upToDate}
+}
+
+func (s *Server) route(ctx context.Context, req *http.Request, updateMetrics func(int)) convreq.HttpResponse {
+	switch req.URL.Path {
+	case "/lookup":
+		return s.serveLookup(ctx, req, updateMetrics)
+	case "/_query/pds":
+		return s.servePDSQuery(ctx, req, updateMetrics)
+	case "/_query/pds/counts":
+		return s.servePDSCounts(ctx, updateMetrics)
+	case "/_resolve":
+		return s.serveBatchResolve(ctx, req, updateMetrics)
+	}
+
+	requestedDid, subpath, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	requestedDid = strings.ToLower(requestedDid)
+
+	switch subpath {
+	case "":
+		return s.serveDocument(ctx, req, requestedDid, updateMetrics)
+	case "log":
+		return s.serveLog(ctx, req, requestedDid, updateMetrics)
+	case "log/audit":
+		return s.serveAuditLog(ctx, req, requestedDid, updateMetrics)
+	case "log/last":
+		return s.serveLastOp(ctx, req, requestedDid, updateMetrics)
+	case "data":
+		return s.serveData(ctx, req, requestedDid, updateMetrics)
+	default:
 		updateMetrics(http.StatusNotFound)
-		return respond.NotFound("unknown DID")
+		return respond.NotFound("not found")
+	}
+}
+
+// lastOperation fetches the latest operation for a DID, or the one that
+// was current at the time given in `?at=` query parameter. If it returns
+// a non-nil response, the caller should return it as is.
+func (s *Server) lastOperation(ctx context.Context, req *http.Request, requestedDid string, updateMetrics func(int)) (*plc.OperationLogEntry, convreq.HttpResponse) {
+	log := zerolog.Ctx(ctx)
+
+	var entry *plc.OperationLogEntry
+	var err error
+	if atStr := req.URL.Query().Get("at"); atStr != "" {
+		at, perr := time.Parse(time.RFC3339, atStr)
+		if perr != nil {
+			updateMetrics(http.StatusBadRequest)
+			return nil, respond.BadRequest(fmt.Sprintf("invalid 'at' value: %s", perr))
+		}
+		entry, err = s.db.OperationForDIDAt(ctx, requestedDid, plc.FormatTimestamp(at))
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			updateMetrics(http.StatusNotFound)
+			return nil, respond.NotFound(fmt.Sprintf("unknown DID or it didn't exist at %s", atStr))
+		}
+	} else {
+		entry, err = s.db.LastOperationForDID(ctx, requestedDid)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if resp := s.proxy(ctx, req, updateMetrics); resp != nil {
+				return nil, resp
+			}
+			updateMetrics(http.StatusNotFound)
+			return nil, respond.NotFound("unknown DID")
+		}
 	}
 	if err != nil {
 		log.Error().Err(err).Str("did", requestedDid).Msgf("Failed to get the last log entry for %q: %s", requestedDid, err)
 		updateMetrics(http.StatusInternalServerError)
-		return respond.InternalServerError("failed to get the last log entry")
-	}
-
-	if _, ok := entry.Operation.Value.(plc.Tombstone); ok {
-		updateMetrics(http.StatusNotFound)
-		return respond.NotFound("DID deleted")
+		return nil, respond.InternalServerError("failed to get the last log entry")
 	}
+	return entry, nil
+}
 
-	var op plc.Op
-	switch v := entry.Operation.Value.(type) {
+func asOp(v plc.OperationKind) plc.Op {
+	switch v := v.(type) {
 	case plc.Op:
-		op = v
+		return v
 	case plc.LegacyCreateOp:
-		op = v.AsUnsignedOp()
+		return v.AsUnsignedOp()
+	}
+	return plc.Op{}
+}
+
+func (s *Server) serveDocument(ctx context.Context, req *http.Request, requestedDid string, updateMetrics func(int)) convreq.HttpResponse {
+	// Historical documents are not cached.
+	useCache := req.URL.Query().Get("at") == ""
+	var generation uint64
+	if useCache {
+		doc, gen, ok := s.docCache.Get(requestedDid)
+		if ok {
+			return s.documentResponse(req, doc, updateMetrics)
+		}
+		generation = gen
+	}
+
+	entry, resp := s.lastOperation(ctx, req, requestedDid, updateMetrics)
+	if resp != nil {
+		return resp
+	}
+
+	doc := newCachedDocument(entry)
+	if useCache {
+		s.docCache.Add(requestedDid, doc, generation)
+	}
+	return s.documentResponse(req, doc, updateMetrics)
+}
+
+func newCachedDocument(entry *plc.OperationLogEntry) cachedDocument {
+	r := cachedDocument{
+		CID:       entry.CID,
+		CreatedAt: entry.CreatedAt,
+	}
+	if _, ok := entry.Operation.Value.(plc.Tombstone); !ok {
+		doc := didDocument(entry)
+		r.Document = &doc
 	}
+	return r
+}
+
+func (s *Server) documentResponse(req *http.Request, doc cachedDocument, updateMetrics func(int)) convreq.HttpResponse {
+	if doc.Document == nil {
+		updateMetrics(http.StatusGone)
+		return respond.Gone("DID deleted")
+	}
+
+	return s.cacheable(req, doc.CID, doc.CreatedAt, updateMetrics, func() convreq.HttpResponse {
+		updateMetrics(http.StatusOK)
+		return respond.JSON(doc.Document)
+	})
+}
+
+// didDocument builds a DID document from the latest operation.
+// Caller must check that the operation is not a tombstone.
+func didDocument(entry *plc.OperationLogEntry) did.Document {
+	op := asOp(entry.Operation.Value)
 
 	didValue := did.DID{
 		Method: "plc",
@@ -159,8 +309,126 @@ func (s *Server) serve(ctx context.Context, req *http.Request) convreq.HttpRespo
 			}
 		}
 	}
-	updateMetrics(http.StatusOK)
-	return respond.JSON(r)
+	return r
+}
+
+// logEntry mirrors the format used by plc.directory for log entries,
+// which always includes the "nullified" field.
+type logEntry struct {
+	DID       string        `json:"did"`
+	Operation plc.Operation `json:"operation"`
+	CID       string        `json:"cid"`
+	Nullified bool          `json:"nullified"`
+	CreatedAt string        `json:"createdAt"`
+}
+
+func toLogEntry(e plc.OperationLogEntry) logEntry {
+	return logEntry{
+		DID:       e.DID,
+		Operation: e.Operation,
+		CID:       e.CID,
+		Nullified: e.Nullified,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// auditLog fetches all log entries for a DID. If it returns a non-nil
+// response, the caller should return it as is.
+func (s *Server) auditLog(ctx context.Context, req *http.Request, requestedDid string, updateMetrics func(int)) ([]plc.OperationLogEntry, convreq.HttpResponse) {
+	log := zerolog.Ctx(ctx)
+
+	entries, err := s.db.AuditLogForDID(ctx, requestedDid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if resp := s.proxy(ctx, req, updateMetrics); resp != nil {
+			return nil, resp
+		}
+		updateMetrics(http.StatusNotFound)
+		return nil, respond.NotFound("unknown DID")
+	}
+	if err != nil {
+		log.Error().Err(err).Str("did", requestedDid).Msgf("Failed to get the audit log for %q: %s", requestedDid, err)
+		updateMetrics(http.StatusInternalServerError)
+		return nil, respond.InternalServerError("failed to get the audit log")
+	}
+	return entries, nil
+}
+
+func (s *Server) serveAuditLog(ctx context.Context, req *http.Request, requestedDid string, updateMetrics func(int)) convreq.HttpResponse {
+	entries, resp := s.auditLog(ctx, req, requestedDid, updateMetrics)
+	if resp != nil {
+		return resp
+	}
+
+	return s.cacheableLog(req, entries, updateMetrics, func() convreq.HttpResponse {
+		updateMetrics(http.StatusOK)
+		return respond.JSON(mapSlice(entries, toLogEntry))
+	})
+}
+
+func (s *Server) serveLog(ctx context.Context, req *http.Request, requestedDid string, updateMetrics func(int)) convreq.HttpResponse {
+	entries, resp := s.auditLog(ctx, req, requestedDid, updateMetrics)
+	if resp != nil {
+		return resp
+	}
+
+	return s.cacheableLog(req, entries, updateMetrics, func() convreq.HttpResponse {
+		ops := []plc.Operation{}
+		for _, e := range entries {
+			if e.Nullified {
+				continue
+			}
+			ops = append(ops, e.Operation)
+		}
+
+		updateMetrics(http.StatusOK)
+		return respond.JSON(ops)
+	})
+}
+
+func (s *Server) serveLastOp(ctx context.Context, req *http.Request, requestedDid string, updateMetrics func(int)) convreq.HttpResponse {
+	entry, resp := s.lastOperation(ctx, req, requestedDid, updateMetrics)
+	if resp != nil {
+		return resp
+	}
+
+	return s.cacheable(req, entry.CID, entry.CreatedAt, updateMetrics, func() convreq.HttpResponse {
+		updateMetrics(http.StatusOK)
+		return respond.JSON(entry.Operation)
+	})
+}
+
+// didData is the format of the /{did}/data response.
+type didData struct {
+	DID                 string                 `json:"did"`
+	VerificationMethods map[string]string      `json:"verificationMethods"`
+	RotationKeys        []string               `json:"rotationKeys"`
+	AlsoKnownAs         []string               `json:"alsoKnownAs"`
+	Services            map[string]plc.Service `json:"services"`
+}
+
+func (s *Server) serveData(ctx context.Context, req *http.Request, requestedDid string, updateMetrics func(int)) convreq.HttpResponse {
+	entry, resp := s.lastOperation(ctx, req, requestedDid, updateMetrics)
+	if resp != nil {
+		return resp
+	}
+
+	if _, ok := entry.Operation.Value.(plc.Tombstone); ok {
+		updateMetrics(http.StatusGone)
+		return respond.Gone(fmt.Sprintf("DID not available: %s", requestedDid))
+	}
+
+	return s.cacheable(req, entry.CID, entry.CreatedAt, updateMetrics, func() convreq.HttpResponse {
+		op := asOp(entry.Operation.Value)
+
+		updateMetrics(http.StatusOK)
+		return respond.JSON(didData{
+			DID:                 entry.DID,
+			VerificationMethods: op.VerificationMethods,
+			RotationKeys:        op.RotationKeys,
+			AlsoKnownAs:         op.AlsoKnownAs,
+			Services:            op.Services,
+		})
+	})
 }
 
 func mapSlice[A any, B any](s []A, fn func(A) B) []B {
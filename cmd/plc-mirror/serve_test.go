@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bsky.watch/plc-mirror/schema/kv"
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+const testDID = "did:plc:test"
+
+// newTestServer returns a server backed by a bbolt database containing
+// a single tombstoned DID, and a mirror whose newest operation is `head`.
+func newTestServer(t *testing.T, head time.Time) *Server {
+	t.Helper()
+	ctx := context.Background()
+
+	db, err := kv.Open(filepath.Join(t.TempDir(), "plc.db"))
+	if err != nil {
+		t.Fatalf("kv.Open: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.AutoMigrate(); err != nil {
+		t.Fatalf("AutoMigrate: %s", err)
+	}
+	entry := plc.OperationLogEntry{DID: testDID, CID: "bafyabc", CreatedAt: "2024-05-01T12:00:00.000Z"}
+	if err := json.Unmarshal([]byte(`{"type":"plc_tombstone","prev":"bafyprev","sig":"sig"}`), &entry.Operation); err != nil {
+		t.Fatalf("unmarshaling operation: %s", err)
+	}
+	if err := db.AppendEntries(ctx, []plc.OperationLogEntry{entry}); err != nil {
+		t.Fatalf("AppendEntries: %s", err)
+	}
+
+	m := &Mirror{db: db, headTimestamp: head}
+	s, err := NewServer(ctx, db, m, 0)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	return s
+}
+
+func TestStaleResponseHeaders(t *testing.T) {
+	cases := []struct {
+		name             string
+		head             time.Time
+		wantWarning      bool
+		wantLag          bool
+		wantCacheControl string
+	}{
+		{"up to date", time.Now(), false, false, "public, max-age=60"},
+		{"behind", time.Now().Add(-time.Hour), true, true, "no-cache"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, tc.head)
+			s.ServeStale = true
+			s.CacheMaxAge = time.Minute
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+testDID+"/log/audit", nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Warning") != ""; got != tc.wantWarning {
+				t.Errorf("has Warning = %v, want %v", got, tc.wantWarning)
+			}
+			if got := w.Header().Get("X-PLC-Mirror-Lag") != ""; got != tc.wantLag {
+				t.Errorf("has X-PLC-Mirror-Lag = %v, want %v", got, tc.wantLag)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tc.wantCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tc.wantCacheControl)
+			}
+		})
+	}
+}
+
+func TestReadThroughAsksUpstreamOnce(t *testing.T) {
+	cases := []struct {
+		name       string
+		head       time.Time
+		path       string
+		upstreamOK bool
+		wantHits   int
+		wantStatus int
+	}{
+		{"behind, upstream fails", time.Now().Add(-time.Hour), "/did:plc:missing", false, 1, http.StatusNotFound},
+		{"behind, upstream ok", time.Now().Add(-time.Hour), "/did:plc:missing", true, 1, http.StatusOK},
+		{"behind, audit log", time.Now().Add(-time.Hour), "/did:plc:missing/log/audit", false, 1, http.StatusNotFound},
+		{"up to date, local miss", time.Now(), "/did:plc:missing", false, 1, http.StatusNotFound},
+		{"up to date, local hit", time.Now(), "/" + testDID + "/log/audit", true, 0, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hits := 0
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				if !tc.upstreamOK {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{}`))
+			}))
+			defer upstream.Close()
+
+			s := newTestServer(t, tc.head)
+			s.ServeStale = true
+			if err := s.EnableReadThrough(upstream.URL, 100); err != nil {
+				t.Fatalf("EnableReadThrough: %s", err)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if hits != tc.wantHits {
+				t.Errorf("upstream was asked %d times, want %d", hits, tc.wantHits)
+			}
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+
+	"bsky.watch/plc-mirror/util/leader"
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+const (
+	streamRetryInterval = 5 * time.Minute
+	streamFlushInterval = time.Second
+	streamMaxBatchSize  = 1000
+	streamPingInterval  = 30 * time.Second
+	streamReadTimeout   = 2 * streamPingInterval
+)
+
+// streamMessage is a single message received from /export/stream.
+type streamMessage struct {
+	Type string `json:"type"`
+	plc.OperationLogEntry
+}
+
+func streamURL(exportURL *url.URL) (*url.URL, error) {
+	u := *exportURL
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	var err error
+	u.Path, err = url.JoinPath(u.Path, "stream")
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// runStream consumes the export stream until it fails or we lose
+// the leadership. It must be called only when we're caught up
+// with upstream.
+func (m *Mirror) runStream(ctx context.Context, leaderLock leader.Elector) error {
+	log := zerolog.Ctx(ctx)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	seq, err := m.db.HeadSeq(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the sequence number cursor: %w", err)
+	}
+
+	u := *m.streamURL
+	if seq > 0 {
+		params := u.Query()
+		params.Set("cursor", strconv.FormatInt(seq, 10))
+		u.RawQuery = params.Encode()
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("connecting to %q: %w", u.String(), err)
+	}
+	defer conn.Close()
+	log.Info().Msgf("Connected to %q", u.String())
+
+	if seq == 0 {
+		// Without a cursor, fill the gap between the last poll and the moment
+		// when the connection got established. Anything received over
+		// the stream that we've already got this way will be deduplicated.
+		if err := m.runOnce(ctx, leaderLock); err != nil {
+			return fmt.Errorf("catching up: %w", err)
+		}
+	}
+
+	entries := make(chan plc.OperationLogEntry, streamMaxBatchSize)
+	var readErr error
+	go func() {
+		defer close(entries)
+		readErr = readStream(ctx, conn, entries)
+	}()
+
+	flushTicker := time.NewTicker(streamFlushInterval)
+	defer flushTicker.Stop()
+	pingTicker := time.NewTicker(streamPingInterval)
+	defer pingTicker.Stop()
+
+	batch := []plc.OperationLogEntry{}
+	flush := func() error {
+		if len(batch) > 0 {
+			stored, err := m.storeEntries(ctx, leaderLock, batch)
+			if err != nil {
+				return err
+			}
+			log.Info().Msgf("Got %d log entries from the stream", len(stored))
+			batch = nil
+		}
+		// As long as the stream is alive, we're up to date with upstream.
+		m.setLastCompletion(ctx, time.Now())
+		return nil
+	}
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				// Store whatever we've got before the stream broke.
+				if err := flush(); err != nil {
+					return err
+				}
+				return readErr
+			}
+			batch = append(batch, entry)
+			if len(batch) >= streamMaxBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-flushTicker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		case <-pingTicker.C:
+			isLeader, err := leaderLock.Check(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to check leadership status: %w", err)
+			}
+			if !isLeader {
+				return errNotLeader
+			}
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamPingInterval))
+			if err != nil {
+				return fmt.Errorf("sending ping: %w", err)
+			}
+		}
+	}
+}
+
+func readStream(ctx context.Context, conn *websocket.Conn, entries chan<- plc.OperationLogEntry) error {
+	log := zerolog.Ctx(ctx)
+
+	conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	})
+
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("reading from the stream: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+
+		var msg streamMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			return fmt.Errorf("parsing stream message: %w", err)
+		}
+		if msg.Type != "" && msg.Type != "sequenced_op" {
+			log.Debug().Msgf("Skipping stream message of type %q", msg.Type)
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, msg.CreatedAt)
+		if err == nil {
+			lastEventTimestamp.Set(float64(t.Unix()))
+		} else {
+			log.Warn().Msgf("Failed to parse %q: %s", msg.CreatedAt, err)
+		}
+
+		select {
+		case entries <- msg.OperationLogEntry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+const (
+	minFailureBackoff = 10 * time.Second
+	maxFailureBackoff = 10 * time.Minute
+	peerCheckInterval = 10 * time.Minute
+	peerCheckCount    = 100
+)
+
+// upstream is a single source of PLC operations: either plc.directory
+// itself, or a peer mirror.
+type upstream struct {
+	exportURL *url.URL
+	// authoritative is set for the source of truth. Peers are used only
+	// when it's unavailable.
+	authoritative bool
+	limiter       *rate.Limiter
+
+	// Only accessed by the mirroring worker, doesn't need locking.
+	seqCursorUnsupported bool
+
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+	verifiedUntil  time.Time
+	// failures is the number of consecutive failed requests.
+	failures int
+	// baseRate is the rate limit that we'd like to use, rateCap is
+	// the limit reported by upstream itself, valid until rateCapUntil.
+	baseRate     rate.Limit
+	rateCap      rate.Limit
+	rateCapUntil time.Time
+}
+
+func newUpstream(s string, authoritative bool) (*upstream, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	u.Path, err = url.JoinPath(u.Path, "export")
+	if err != nil {
+		return nil, err
+	}
+	r := &upstream{
+		exportURL:     u,
+		authoritative: authoritative,
+		limiter:       rate.NewLimiter(defaultRateLimit, 4),
+		baseRate:      defaultRateLimit,
+	}
+	upstreamHealthy.WithLabelValues(r.String()).Set(1)
+	return r, nil
+}
+
+func (u *upstream) String() string {
+	return u.exportURL.Host
+}
+
+func (u *upstream) healthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().After(u.unhealthyUntil)
+}
+
+// markFailure puts the upstream into cooldown, for as long as upstream has
+// asked us to wait or, if it didn't, with exponential backoff.
+func (u *upstream) markFailure(err error) {
+	upstreamFailures.WithLabelValues(u.String(), failureClass(err)).Inc()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures++
+
+	var cooldown time.Duration
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		cooldown = min(statusErr.retryAfter, maxFailureBackoff)
+	} else {
+		cooldown = backoff(u.failures)
+	}
+	u.unhealthyUntil = time.Now().Add(cooldown)
+	upstreamHealthy.WithLabelValues(u.String()).Set(0)
+}
+
+// backoff returns a randomized delay before the next attempt after
+// the given number of consecutive failures.
+func backoff(failures int) time.Duration {
+	d := maxFailureBackoff
+	if failures < 16 {
+		d = min(minFailureBackoff<<(failures-1), maxFailureBackoff)
+	}
+	// Equal jitter: at least half of the delay, to actually back off,
+	// and a random remainder, to not retry in lockstep with other clients.
+	return d/2 + rand.N(d/2+1)
+}
+
+func (u *upstream) markSuccess() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.unhealthyUntil = time.Time{}
+	u.failures = 0
+	upstreamHealthy.WithLabelValues(u.String()).Set(1)
+}
+
+// availableAt returns the time when the upstream gets out of cooldown.
+func (u *upstream) availableAt() time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.unhealthyUntil
+}
+
+func (u *upstream) verified() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Now().Before(u.verifiedUntil)
+}
+
+func (u *upstream) setVerified(ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ok {
+		u.verifiedUntil = time.Now().Add(peerCheckInterval)
+		upstreamConsistent.WithLabelValues(u.String()).Set(1)
+	} else {
+		u.verifiedUntil = time.Time{}
+		upstreamConsistent.WithLabelValues(u.String()).Set(0)
+	}
+}
+
+func (u *upstream) updateRateLimit(desiredRate rate.Limit) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.baseRate = desiredRate
+	u.applyRateLimit()
+}
+
+// applyRateLimit must be called with `u.mu` held.
+func (u *upstream) applyRateLimit() {
+	desiredRate := u.baseRate
+	if time.Now().Before(u.rateCapUntil) && u.rateCap < desiredRate {
+		desiredRate = u.rateCap
+	}
+	if math.Abs(float64(u.limiter.Limit()-desiredRate)) > 0.0000001 {
+		u.limiter.SetLimit(desiredRate)
+	}
+}
+
+// observeRateLimit adjusts the limiter to not exceed the request budget
+// that upstream has reported in the response headers.
+func (u *upstream) observeRateLimit(h http.Header) {
+	remaining, err := strconv.Atoi(rateLimitHeader(h, "Remaining"))
+	if err != nil {
+		return
+	}
+	resetSeconds, err := strconv.Atoi(rateLimitHeader(h, "Reset"))
+	if err != nil || resetSeconds <= 0 {
+		return
+	}
+	reset := time.Duration(resetSeconds) * time.Second
+	if resetSeconds > 1000000000 {
+		// Some servers send a Unix timestamp instead of the number of seconds.
+		reset = time.Until(time.Unix(int64(resetSeconds), 0))
+		if reset <= 0 {
+			return
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// Spread the remaining budget evenly until the reset, but still allow
+	// at least one request, otherwise the limiter would block forever.
+	u.rateCap = rate.Limit(float64(max(remaining, 1)) / reset.Seconds())
+	u.rateCapUntil = time.Now().Add(reset)
+	u.applyRateLimit()
+}
+
+func rateLimitHeader(h http.Header, name string) string {
+	if v := h.Get("RateLimit-" + name); v != "" {
+		return v
+	}
+	return h.Get("X-RateLimit-" + name)
+}
+
+// parseRetryAfter parses the value of Retry-After header, which can be
+// either a number of seconds or an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+type statusError struct {
+	code int
+	// retryAfter is zero if upstream didn't tell us when to retry.
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("unexpected status code: %d (retry after %s)", e.code, e.retryAfter)
+	}
+	return fmt.Sprintf("unexpected status code: %d", e.code)
+}
+
+// failureClass is used as a metric label, to tell throttling
+// apart from outages.
+func failureClass(err error) string {
+	var statusErr *statusError
+	var decodeErr *decodeError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.code == http.StatusTooManyRequests:
+		return "throttled"
+	case errors.As(err, &statusErr) && statusErr.code >= 500:
+		return "server_error"
+	case errors.As(err, &statusErr):
+		return "client_error"
+	case errors.As(err, &decodeErr):
+		return "invalid_response"
+	default:
+		return "network"
+	}
+}
+
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("parsing log entry: %s", e.err)
+}
+
+func (e *decodeError) Unwrap() error {
+	return e.err
+}
+
+// fetchPage makes a single request to /export.
+func (u *upstream) fetchPage(ctx context.Context, after string, count int) ([]plc.OperationLogEntry, error) {
+	log := zerolog.Ctx(ctx)
+
+	reqURL := *u.exportURL
+	params := reqURL.Query()
+	params.Set("count", strconv.Itoa(count))
+	if after != "" {
+		params.Set("after", after)
+	}
+	reqURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("constructing request: %w", err)
+	}
+
+	_ = u.limiter.Wait(ctx)
+	log.Debug().Msgf("Request URL: %s", reqURL.String())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	u.observeRateLimit(resp.Header)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{
+			code:       resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	entries := []plc.OperationLogEntry{}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry plc.OperationLogEntry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, &decodeError{err: err}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// pageSample is a page of entries that was received from a trusted source,
+// used as a reference for checking peers.
+type pageSample struct {
+	// after is the timestamp cursor of the page. afterSeq is the sequence
+	// number cursor, or 0 if the page was fetched using timestamps.
+	after    string
+	afterSeq int64
+	cids     []string
+}
+
+func sampleOf(after string, afterSeq int64, entries []plc.OperationLogEntry) *pageSample {
+	return &pageSample{
+		after:    after,
+		afterSeq: afterSeq,
+		cids:     cidsOf(entries),
+	}
+}
+
+// cidsOf returns CIDs of up to peerCheckCount first entries.
+func cidsOf(entries []plc.OperationLogEntry) []string {
+	if len(entries) > peerCheckCount {
+		entries = entries[:peerCheckCount]
+	}
+	return mapSlice(entries, func(e plc.OperationLogEntry) string { return e.CID })
+}
+
+// fetchSample fetches the same page as `ref` from the upstream. Sequence
+// number cursor is used if both the reference and the upstream have it,
+// since with timestamps entries at page boundaries might differ.
+func (u *upstream) fetchSample(ctx context.Context, ref *pageSample) ([]plc.OperationLogEntry, error) {
+	if ref.afterSeq > 0 && !u.seqCursorUnsupported {
+		got, err := u.fetchPage(ctx, strconv.FormatInt(ref.afterSeq, 10), len(ref.cids))
+		var statusErr *statusError
+		switch {
+		case errors.As(err, &statusErr) && statusErr.code == http.StatusBadRequest:
+			u.seqCursorUnsupported = true
+		case err == nil && len(got) > 0 && got[0].Seq <= ref.afterSeq:
+			// Cursor was interpreted as something else.
+			u.seqCursorUnsupported = true
+		default:
+			return got, err
+		}
+	}
+	return u.fetchPage(ctx, ref.after, len(ref.cids))
+}
+
+// compareSamples checks that `got` is consistent with `want`. `got` is
+// allowed to have more entries than `want`, but not fewer, unless `complete`
+// is false, i.e. `want` might be missing some entries itself.
+func compareSamples(want []string, got []string, complete bool) error {
+	for i := range min(len(want), len(got)) {
+		if want[i] != got[i] {
+			return fmt.Errorf("forked: entry #%d is %q instead of %q", i, got[i], want[i])
+		}
+	}
+	if complete && len(got) < len(want) {
+		return fmt.Errorf("lagging: got %d entries instead of %d", len(got), len(want))
+	}
+	return nil
+}
+
+// pickUpstream returns the upstream that should be used next, or nil if
+// none are currently available. Authoritative upstream is always preferred.
+// Peers are checked for consistency before being used.
+func (m *Mirror) pickUpstream(ctx context.Context, after string) *upstream {
+	log := zerolog.Ctx(ctx)
+
+	for _, up := range m.upstreams {
+		if !up.healthy() {
+			continue
+		}
+		if up.authoritative || up.verified() {
+			return up
+		}
+		if err := m.checkPeer(ctx, up, after); err != nil {
+			log.Warn().Err(err).Str("upstream", up.String()).Msgf("Peer %q is not consistent, not using it: %s", up, err)
+			up.setVerified(false)
+			continue
+		}
+		log.Info().Str("upstream", up.String()).Msgf("Peer %q passed the consistency check", up)
+		up.setVerified(true)
+		return up
+	}
+	return nil
+}
+
+// checkPeer compares what the peer returns against the last page received
+// from a trusted source. If we don't have any yet, the peer is compared
+// against all other peers instead.
+func (m *Mirror) checkPeer(ctx context.Context, up *upstream, after string) error {
+	if m.reference != nil {
+		got, err := up.fetchSample(ctx, m.reference)
+		if err != nil {
+			up.markFailure(err)
+			return err
+		}
+		return compareSamples(m.reference.cids, cidsOf(got), true)
+	}
+
+	got, err := up.fetchPage(ctx, after, peerCheckCount)
+	if err != nil {
+		up.markFailure(err)
+		return err
+	}
+	sample := cidsOf(got)
+
+	for _, other := range m.upstreams {
+		if other == up || other.authoritative || !other.healthy() {
+			continue
+		}
+		entries, err := other.fetchPage(ctx, after, peerCheckCount)
+		if err != nil {
+			other.markFailure(err)
+			continue
+		}
+		// Since neither of the peers is trusted, we can't tell which one
+		// is right if they differ. But if one is strictly behind
+		// the other - it's lagging.
+		if err := compareSamples(cidsOf(entries), sample, true); err != nil {
+			return fmt.Errorf("compared to %q: %w", other, err)
+		}
+	}
+	return nil
+}
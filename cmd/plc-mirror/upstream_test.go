@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// timestampOnlyPeer serves /export like an upstream that doesn't support
+// sequence number cursors.
+func timestampOnlyPeer(t *testing.T, cids []string) *upstream {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if after := r.URL.Query().Get("after"); !strings.Contains(after, "T") {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		for _, cid := range cids {
+			fmt.Fprintf(w, `{"did":"did:plc:test","cid":%q,"createdAt":"2024-05-01T12:00:00.000Z","operation":{"type":"plc_tombstone","prev":"x","sig":"y"}}`+"\n", cid)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	up, err := newUpstream(srv.URL, false)
+	if err != nil {
+		t.Fatalf("newUpstream: %s", err)
+	}
+	return up
+}
+
+func TestCheckPeerWithoutSeqSupport(t *testing.T) {
+	ctx := context.Background()
+	cids := []string{"bafy1", "bafy2", "bafy3"}
+	up := timestampOnlyPeer(t, cids)
+
+	m := &Mirror{
+		upstreams: []*upstream{up},
+		reference: &pageSample{after: "2024-05-01T11:00:00.000Z", afterSeq: 42, cids: cids},
+	}
+	if err := m.checkPeer(ctx, up, ""); err != nil {
+		t.Fatalf("checkPeer: %s", err)
+	}
+	if !up.seqCursorUnsupported {
+		t.Errorf("peer is not marked as not supporting sequence numbers")
+	}
+	if !up.healthy() {
+		t.Errorf("peer is marked as unhealthy")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+type verificationError struct {
+	reason string
+	err    error
+}
+
+func (e *verificationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.err)
+}
+
+func (e *verificationError) Unwrap() error {
+	return e.err
+}
+
+// checkGenesisDIDs filters out genesis operations that don't hash to the DID
+// they are reported for. Unlike other checks this one doesn't require
+// any DB lookups, so it's always enabled.
+func checkGenesisDIDs(ctx context.Context, entries []plc.OperationLogEntry) []plc.OperationLogEntry {
+	log := zerolog.Ctx(ctx)
+
+	r := make([]plc.OperationLogEntry, 0, len(entries))
+	for _, entry := range entries {
+		if plc.PrevCID(entry.Operation.Value) == "" {
+			did, err := plc.DIDFromGenesis(entry.Operation.Value)
+			if err == nil && did != entry.DID {
+				err = fmt.Errorf("genesis operation is for %q", did)
+			}
+			if err != nil {
+				verificationFailures.WithLabelValues("did_mismatch").Inc()
+				log.Warn().Err(err).Str("did", entry.DID).Str("cid", entry.CID).
+					Msgf("Genesis operation %q for %q failed verification: %s", entry.CID, entry.DID, err)
+				continue
+			}
+		}
+		r = append(r, entry)
+	}
+	return r
+}
+
+func verifyEntry(known []plc.OperationLogEntry, entry plc.OperationLogEntry) error {
+	if err := plc.VerifyCID(entry); err != nil {
+		return &verificationError{reason: "cid_mismatch", err: err}
+	}
+
+	var keys []string
+	prev := plc.PrevCID(entry.Operation.Value)
+	if prev == "" {
+		if _, ok := entry.Operation.Value.(plc.Tombstone); ok {
+			return &verificationError{reason: "invalid_genesis", err: fmt.Errorf("genesis operation can't be a tombstone")}
+		}
+		for _, e := range known {
+			if plc.PrevCID(e.Operation.Value) == "" {
+				return &verificationError{reason: "invalid_genesis", err: fmt.Errorf("DID already has a genesis operation %q", e.CID)}
+			}
+		}
+		keys = plc.RotationKeys(entry.Operation.Value)
+	} else {
+		found := false
+		for _, e := range known {
+			if e.CID == prev {
+				keys = plc.RotationKeys(e.Operation.Value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &verificationError{reason: "prev_not_found", err: fmt.Errorf("previous operation %q not found", prev)}
+		}
+	}
+
+	if _, err := plc.VerifySignature(entry.Operation.Value, keys); err != nil {
+		return &verificationError{reason: "invalid_signature", err: err}
+	}
+	return nil
+}
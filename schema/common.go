@@ -3,20 +3,87 @@ package schema
 import (
 	"context"
 	"fmt"
+	"time"
 
 	v1 "bsky.watch/plc-mirror/schema/v1"
 	v2 "bsky.watch/plc-mirror/schema/v2"
+	v3 "bsky.watch/plc-mirror/schema/v3"
 	"bsky.watch/plc-mirror/util/plc"
 	"gorm.io/gorm"
 )
 
 type Database interface {
 	HeadTimestamp(ctx context.Context) (string, error)
+	// HeadSeq returns the highest stored sequence number, or 0 if none
+	// of the stored entries have one.
+	HeadSeq(ctx context.Context) (int64, error)
+	// AppendEntries stores new log entries. If the context carries
+	// a fencing token (see leader.WithToken), the write is rejected with
+	// leader.ErrStaleLeader once the token is no longer current.
+	// NullifyEntries follows the same rule.
 	AppendEntries(ctx context.Context, entries []plc.OperationLogEntry) error
 	LastOperationForDID(ctx context.Context, did string) (*plc.OperationLogEntry, error)
+	// LastOperationsForDIDs is the same as LastOperationForDID, but for
+	// multiple DIDs at once, fetched with a single query. DIDs that are
+	// not present in the database are omitted from the result.
+	LastOperationsForDIDs(ctx context.Context, dids []string) (map[string]*plc.OperationLogEntry, error)
+	// OperationForDIDAt returns the latest non-nullified operation for
+	// a DID with timestamp at or before `at`, or gorm.ErrRecordNotFound
+	// if there isn't one. `at` must be in the same format as timestamps
+	// of log entries, see plc.FormatTimestamp.
+	OperationForDIDAt(ctx context.Context, did string, at string) (*plc.OperationLogEntry, error)
+	// AuditLogForDID returns all log entries for a given DID, including
+	// nullified ones, in chronological order.
+	AuditLogForDID(ctx context.Context, did string) ([]plc.OperationLogEntry, error)
+	// AuditLogsForDIDs is the same as AuditLogForDID, but for multiple DIDs
+	// at once. DIDs that are not present in the database are omitted
+	// from the result.
+	AuditLogsForDIDs(ctx context.Context, dids []string) (map[string][]plc.OperationLogEntry, error)
+	// NullifyEntries marks log entries as nullified. `entries` maps DIDs
+	// to CIDs of the entries.
+	NullifyEntries(ctx context.Context, entries map[string][]string) error
+	// LastCompletion returns the last time the leader has finished polling
+	// upstream successfully, or zero time if it's not known.
+	LastCompletion(ctx context.Context) (time.Time, error)
+	// SetLastCompletion records the time of the last successful poll,
+	// so that it's visible to all replicas. Older values are ignored.
+	SetLastCompletion(ctx context.Context, t time.Time) error
 	AutoMigrate() error
 }
 
+// Exporter is implemented by databases that store operations in a table
+// indexed by timestamp and sequence number. Schema v2 keeps whole logs
+// in a single row per DID, so exporting from it would require a full scan
+// for every page.
+type Exporter interface {
+	// Export returns up to `count` log entries with timestamp strictly
+	// greater than `after`, ordered by timestamp. Semantics match
+	// those of plc.directory's /export endpoint.
+	Export(ctx context.Context, after string, count int) ([]plc.OperationLogEntry, error)
+	// ExportBySeq is the same as Export, but uses sequence numbers
+	// instead of timestamps. Entries without a sequence number are skipped.
+	ExportBySeq(ctx context.Context, after int64, count int) ([]plc.OperationLogEntry, error)
+}
+
+// AlsoKnownAsIndex is implemented by databases that can look up DIDs
+// by their current alsoKnownAs values.
+type AlsoKnownAsIndex interface {
+	// DIDsByAlsoKnownAs returns all DIDs that currently claim `uri`
+	// (case-insensitive). Nullified operations and tombstoned DIDs
+	// are not taken into account.
+	DIDsByAlsoKnownAs(ctx context.Context, uri string) ([]string, error)
+}
+
+// PDSIndex is implemented by databases that can look up DIDs by their
+// current PDS.
+type PDSIndex interface {
+	// DIDsByPDSHost returns up to `limit` DIDs, greater than `after`,
+	// whose atproto_pds service currently points at `host`, ordered by DID.
+	DIDsByPDSHost(ctx context.Context, host string, after string, limit int) ([]string, error)
+	// PDSHostCounts returns the number of DIDs for each PDS host.
+	PDSHostCounts(ctx context.Context) (map[string]int64, error)
+}
+
 func DetectVersion(ctx context.Context, db *gorm.DB) (Database, error) {
 	r, err := detectInternal(ctx, db)
 	if err != nil {
@@ -29,7 +96,15 @@ func DetectVersion(ctx context.Context, db *gorm.DB) (Database, error) {
 }
 
 func detectInternal(ctx context.Context, db *gorm.DB) (Database, error) {
-	ok, err := v2.IsActive(ctx, db)
+	ok, err := v3.IsActive(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("checking iv v3 schema is in use: %w", err)
+	}
+	if ok {
+		return v3.New(db), nil
+	}
+
+	ok, err = v2.IsActive(ctx, db)
 	if err != nil {
 		return nil, fmt.Errorf("checking iv v2 schema is in use: %w", err)
 	}
@@ -47,5 +122,5 @@ func detectInternal(ctx context.Context, db *gorm.DB) (Database, error) {
 
 	// If we reach this point, none of the known schemas are in use
 	// and the DB is most likely empty. So just use the latest schema.
-	return v2.New(db), nil
+	return v3.New(db), nil
 }
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+
+	typegen "github.com/whyrusleeping/cbor-gen"
+
+	"bsky.watch/plc-mirror/schema/kv"
+)
+
+func main() {
+	if err := typegen.WriteTupleEncodersToFile("cbor_gen.go", "kv", kv.Log{}, kv.LogEntry{}); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
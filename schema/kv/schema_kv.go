@@ -0,0 +1,451 @@
+// Package kv implements storage in an embedded bbolt database, for
+// single-node deployments that need to serve lookups without a round-trip
+// to an SQL server.
+//
+// Layout:
+//   - "logs": DID -> Log, CBOR-encoded
+//   - "by_timestamp": createdAt \0 DID \0 CID -> empty, used by Export
+//   - "by_seq": big-endian seq -> DID \0 CID, used by ExportBySeq
+//   - "meta": head timestamp, head seq and last completion time
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gorm.io/gorm"
+
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+var (
+	logsBucket        = []byte("logs")
+	byTimestampBucket = []byte("by_timestamp")
+	bySeqBucket       = []byte("by_seq")
+	metaBucket        = []byte("meta")
+
+	headTimestampKey  = []byte("head_timestamp")
+	headSeqKey        = []byte("head_seq")
+	lastCompletionKey = []byte("last_completion")
+)
+
+type Database struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Database, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Database{db: db}, nil
+}
+
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+func (d *Database) AutoMigrate() error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{logsBucket, byTimestampBucket, bySeqBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("creating bucket %q: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) HeadTimestamp(ctx context.Context) (string, error) {
+	var r string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		r = string(tx.Bucket(metaBucket).Get(headTimestampKey))
+		return nil
+	})
+	if err == nil && r == "" {
+		return "", gorm.ErrRecordNotFound
+	}
+	return r, err
+}
+
+func (d *Database) HeadSeq(ctx context.Context) (int64, error) {
+	var r int64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket).Get(headSeqKey); b != nil {
+			r = int64(binary.BigEndian.Uint64(b))
+		}
+		return nil
+	})
+	return r, err
+}
+
+func (d *Database) LastCompletion(ctx context.Context) (time.Time, error) {
+	var r time.Time
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaBucket).Get(lastCompletionKey); b != nil {
+			r = time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+		}
+		return nil
+	})
+	return r, err
+}
+
+func (d *Database) SetLastCompletion(ctx context.Context, t time.Time) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if b := meta.Get(lastCompletionKey); b != nil && int64(binary.BigEndian.Uint64(b)) >= t.UnixNano() {
+			return nil
+		}
+		return meta.Put(lastCompletionKey, binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano())))
+	})
+}
+
+// AppendEntries doesn't check fencing tokens: bbolt holds an exclusive lock
+// on the file, so only a single process can write to it.
+func (d *Database) AppendEntries(ctx context.Context, entries []plc.OperationLogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	byDID := map[string][]plc.OperationLogEntry{}
+	for _, entry := range entries {
+		byDID[entry.DID] = append(byDID[entry.DID], entry)
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		logs := tx.Bucket(logsBucket)
+		byTimestamp := tx.Bucket(byTimestampBucket)
+		bySeq := tx.Bucket(bySeqBucket)
+
+		for did, newEntries := range byDID {
+			log, err := getLog(logs, did)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range newEntries {
+				if slices.ContainsFunc(log.Entries, func(e LogEntry) bool { return e.CID == entry.CID }) {
+					continue
+				}
+				e, err := fromOperationLogEntry(entry)
+				if err != nil {
+					return fmt.Errorf("encoding entry %q for %q: %w", entry.CID, did, err)
+				}
+				log.Entries = append(log.Entries, e)
+
+				if err := byTimestamp.Put(timestampKey(e.CreatedAt, did, e.CID), nil); err != nil {
+					return err
+				}
+				if e.Seq > 0 {
+					if err := bySeq.Put(seqKey(e.Seq), []byte(did+"\x00"+e.CID)); err != nil {
+						return err
+					}
+				}
+			}
+			slices.SortStableFunc(log.Entries, func(a, b LogEntry) int {
+				return strings.Compare(a.CreatedAt, b.CreatedAt)
+			})
+
+			if err := putLog(logs, did, log); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if ts := plc.NextCursor(entries); ts > string(meta.Get(headTimestampKey)) {
+			if err := meta.Put(headTimestampKey, []byte(ts)); err != nil {
+				return err
+			}
+		}
+		if seq := plc.NextSeqCursor(entries); seq > 0 {
+			b := meta.Get(headSeqKey)
+			if b == nil || int64(binary.BigEndian.Uint64(b)) < seq {
+				if err := meta.Put(headSeqKey, seqKey(seq)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) LastOperationForDID(ctx context.Context, did string) (*plc.OperationLogEntry, error) {
+	entries, err := d.AuditLogForDID(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].Nullified {
+			return &entries[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (d *Database) OperationForDIDAt(ctx context.Context, did string, at string) (*plc.OperationLogEntry, error) {
+	entries, err := d.AuditLogForDID(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].Nullified && entries[i].CreatedAt <= at {
+			return &entries[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (d *Database) LastOperationsForDIDs(ctx context.Context, dids []string) (map[string]*plc.OperationLogEntry, error) {
+	logs, err := d.AuditLogsForDIDs(ctx, dids)
+	if err != nil {
+		return nil, err
+	}
+	r := map[string]*plc.OperationLogEntry{}
+	for did, entries := range logs {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if !entries[i].Nullified {
+				r[did] = &entries[i]
+				break
+			}
+		}
+	}
+	return r, nil
+}
+
+func (d *Database) AuditLogForDID(ctx context.Context, did string) ([]plc.OperationLogEntry, error) {
+	r, err := d.AuditLogsForDIDs(ctx, []string{did})
+	if err != nil {
+		return nil, err
+	}
+	if len(r[did]) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return r[did], nil
+}
+
+func (d *Database) AuditLogsForDIDs(ctx context.Context, dids []string) (map[string][]plc.OperationLogEntry, error) {
+	r := map[string][]plc.OperationLogEntry{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		logs := tx.Bucket(logsBucket)
+		for _, did := range dids {
+			log, err := getLog(logs, did)
+			if err != nil {
+				return err
+			}
+			if len(log.Entries) == 0 {
+				continue
+			}
+			entries := make([]plc.OperationLogEntry, 0, len(log.Entries))
+			for _, e := range log.Entries {
+				entry, err := toOperationLogEntry(did, e)
+				if err != nil {
+					return fmt.Errorf("decoding entry %q for %q: %w", e.CID, did, err)
+				}
+				entries = append(entries, entry)
+			}
+			r[did] = entries
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (d *Database) NullifyEntries(ctx context.Context, entries map[string][]string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		logs := tx.Bucket(logsBucket)
+		for did, cids := range entries {
+			log, err := getLog(logs, did)
+			if err != nil {
+				return err
+			}
+			for i := range log.Entries {
+				if slices.Contains(cids, log.Entries[i].CID) {
+					log.Entries[i].Nullified = true
+				}
+			}
+			if err := putLog(logs, did, log); err != nil {
+				return fmt.Errorf("updating entries for %q: %w", did, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) Export(ctx context.Context, after string, count int) ([]plc.OperationLogEntry, error) {
+	r := []plc.OperationLogEntry{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		logs := tx.Bucket(logsBucket)
+		c := tx.Bucket(byTimestampBucket).Cursor()
+		// All keys with timestamp equal to `after` are followed by \0,
+		// so this skips them.
+		for k, _ := c.Seek([]byte(after + "\x01")); k != nil && len(r) < count; k, _ = c.Next() {
+			parts := bytes.SplitN(k, []byte{0}, 3)
+			if len(parts) != 3 {
+				return fmt.Errorf("malformed index key %q", k)
+			}
+			entry, err := findEntry(logs, string(parts[1]), string(parts[2]))
+			if err != nil {
+				return err
+			}
+			r = append(r, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (d *Database) ExportBySeq(ctx context.Context, after int64, count int) ([]plc.OperationLogEntry, error) {
+	r := []plc.OperationLogEntry{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		logs := tx.Bucket(logsBucket)
+		c := tx.Bucket(bySeqBucket).Cursor()
+		for k, v := c.Seek(seqKey(after + 1)); k != nil && len(r) < count; k, v = c.Next() {
+			did, cid, ok := strings.Cut(string(v), "\x00")
+			if !ok {
+				return fmt.Errorf("malformed index value %q", v)
+			}
+			entry, err := findEntry(logs, did, cid)
+			if err != nil {
+				return err
+			}
+			r = append(r, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func timestampKey(createdAt string, did string, cid string) []byte {
+	return []byte(createdAt + "\x00" + did + "\x00" + cid)
+}
+
+func seqKey(seq int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(seq))
+}
+
+func getLog(logs *bolt.Bucket, did string) (*Log, error) {
+	log := &Log{}
+	b := logs.Get([]byte(did))
+	if b == nil {
+		return log, nil
+	}
+	if err := log.UnmarshalCBOR(bytes.NewReader(b)); err != nil {
+		return nil, fmt.Errorf("decoding log for %q: %w", did, err)
+	}
+	return log, nil
+}
+
+func putLog(logs *bolt.Bucket, did string, log *Log) error {
+	buf := bytes.NewBuffer(nil)
+	if err := log.MarshalCBOR(buf); err != nil {
+		return fmt.Errorf("encoding log for %q: %w", did, err)
+	}
+	return logs.Put([]byte(did), buf.Bytes())
+}
+
+func findEntry(logs *bolt.Bucket, did string, cid string) (plc.OperationLogEntry, error) {
+	log, err := getLog(logs, did)
+	if err != nil {
+		return plc.OperationLogEntry{}, err
+	}
+	for _, e := range log.Entries {
+		if e.CID == cid {
+			return toOperationLogEntry(did, e)
+		}
+	}
+	return plc.OperationLogEntry{}, fmt.Errorf("index points to a missing entry %q for %q", cid, did)
+}
+
+func toOperationLogEntry(did string, e LogEntry) (plc.OperationLogEntry, error) {
+	r := plc.OperationLogEntry{
+		DID:       did,
+		CID:       e.CID,
+		CreatedAt: e.CreatedAt,
+		Nullified: e.Nullified,
+		Seq:       e.Seq,
+	}
+	rd := bytes.NewReader(e.Operation)
+	switch e.Type {
+	case "plc_operation":
+		var op plc.Op
+		if err := op.UnmarshalCBOR(rd); err != nil {
+			return r, err
+		}
+		// Decoder leaves empty arrays as nil, which would be
+		// serialized as null instead of [].
+		if op.RotationKeys == nil {
+			op.RotationKeys = []string{}
+		}
+		if op.AlsoKnownAs == nil {
+			op.AlsoKnownAs = []string{}
+		}
+		if op.VerificationMethods == nil {
+			op.VerificationMethods = map[string]string{}
+		}
+		if op.Services == nil {
+			op.Services = map[string]plc.Service{}
+		}
+		r.Operation.Value = op
+	case "plc_tombstone":
+		var op plc.Tombstone
+		if err := op.UnmarshalCBOR(rd); err != nil {
+			return r, err
+		}
+		r.Operation.Value = op
+	case "create":
+		var op plc.LegacyCreateOp
+		if err := op.UnmarshalCBOR(rd); err != nil {
+			return r, err
+		}
+		r.Operation.Value = op
+	default:
+		return r, fmt.Errorf("unsupported operation type %q", e.Type)
+	}
+	return r, nil
+}
+
+func fromOperationLogEntry(entry plc.OperationLogEntry) (LogEntry, error) {
+	r := LogEntry{
+		CID:       entry.CID,
+		CreatedAt: entry.CreatedAt,
+		Nullified: entry.Nullified,
+		Seq:       entry.Seq,
+	}
+	buf := bytes.NewBuffer(nil)
+	switch op := entry.Operation.Value.(type) {
+	case plc.Op:
+		r.Type = "plc_operation"
+		if err := op.MarshalCBOR(buf); err != nil {
+			return r, err
+		}
+	case plc.Tombstone:
+		r.Type = "plc_tombstone"
+		if err := op.MarshalCBOR(buf); err != nil {
+			return r, err
+		}
+	case plc.LegacyCreateOp:
+		r.Type = "create"
+		if err := op.MarshalCBOR(buf); err != nil {
+			return r, err
+		}
+	default:
+		return r, fmt.Errorf("unsupported operation type %T", op)
+	}
+	r.Operation = buf.Bytes()
+	return r, nil
+}
@@ -0,0 +1,83 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ops := []string{
+		`{"type":"create","signingKey":"did:key:a","recoveryKey":"did:key:b","handle":"alice.example.com","service":"https://pds.example.com","prev":null,"sig":"sig0"}`,
+		`{"type":"plc_operation","rotationKeys":["did:key:b"],"verificationMethods":{"atproto":"did:key:a"},"alsoKnownAs":["at://alice.example.com"],"services":{"atproto_pds":{"type":"AtprotoPersonalDataServer","endpoint":"https://pds.example.com"}},"prev":"cid0","sig":"sig1"}`,
+		`{"type":"plc_operation","rotationKeys":[],"verificationMethods":{},"alsoKnownAs":[],"services":{},"prev":"cid1","sig":"sig2"}`,
+		`{"type":"plc_tombstone","prev":"cid2","sig":"sig3"}`,
+	}
+	timestamps := []string{
+		"2024-01-01T00:00:00.000Z",
+		"2024-01-02T00:00:00.000Z",
+		"2024-01-03T00:00:00.000Z",
+		"2024-01-04T00:00:00.000Z",
+	}
+
+	entries := []plc.OperationLogEntry{}
+	for i, op := range ops {
+		entry := plc.OperationLogEntry{
+			DID:       "did:plc:test",
+			CID:       "cid" + string(rune('0'+i)),
+			CreatedAt: timestamps[i],
+			Seq:       int64(i + 1),
+		}
+		if err := json.Unmarshal([]byte(op), &entry.Operation); err != nil {
+			t.Fatalf("unmarshaling op #%d: %s", i, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	ctx := context.Background()
+	db, err := Open(filepath.Join(t.TempDir(), "plc.db"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer db.Close()
+	if err := db.AutoMigrate(); err != nil {
+		t.Fatalf("AutoMigrate: %s", err)
+	}
+	if err := db.AppendEntries(ctx, entries); err != nil {
+		t.Fatalf("AppendEntries: %s", err)
+	}
+
+	check := func(name string, got []plc.OperationLogEntry) {
+		t.Helper()
+		if len(got) != len(ops) {
+			t.Fatalf("%s returned %d entries, want %d", name, len(got), len(ops))
+		}
+		for i, e := range got {
+			b, err := json.Marshal(e.Operation)
+			if err != nil {
+				t.Fatalf("%s: marshaling op #%d: %s", name, i, err)
+			}
+			if string(b) != ops[i] {
+				t.Errorf("%s: op #%d:\ngot  %s\nwant %s", name, i, b, ops[i])
+			}
+			if e.CID != entries[i].CID || e.CreatedAt != entries[i].CreatedAt || e.Seq != entries[i].Seq {
+				t.Errorf("%s: entry #%d metadata mismatch: got %+v", name, i, e)
+			}
+		}
+	}
+
+	log, err := db.AuditLogForDID(ctx, "did:plc:test")
+	if err != nil {
+		t.Fatalf("AuditLogForDID: %s", err)
+	}
+	check("AuditLogForDID", log)
+
+	exported, err := db.Export(ctx, "", 10)
+	if err != nil {
+		t.Fatalf("Export: %s", err)
+	}
+	check("Export", exported)
+}
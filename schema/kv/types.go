@@ -0,0 +1,24 @@
+package kv
+
+//go:generate go run ./gen
+
+// Log is the value stored for each DID: all of its log entries,
+// in chronological order.
+type Log struct {
+	// Some spam DIDs have very long logs, so the default limit
+	// of cbor-gen is not enough.
+	Entries []LogEntry `cborgen:"maxlen=1000000"`
+}
+
+type LogEntry struct {
+	CID       string
+	CreatedAt string
+	Nullified bool
+	Seq       int64
+	// Type is the value of operation's "type" field, needed to pick
+	// the right type for decoding.
+	Type string
+	// Operation is the DAG-CBOR encoding of the operation, i.e. the same
+	// bytes that its CID is computed from.
+	Operation []byte
+}
@@ -0,0 +1,176 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/imax9000/errors"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+
+	v1 "bsky.watch/plc-mirror/schema/v1"
+	v2 "bsky.watch/plc-mirror/schema/v2"
+)
+
+// catchUpMinRows is the number of rows added to v1 since the previous
+// catch-up pass below which the migration stops catching up.
+const catchUpMinRows = 1000
+
+// MigrateV1ToV2 copies all data from schema v1 into schema v2. It can
+// be interrupted and restarted at any point, and is safe to run while other
+// replicas are still using v1: until the migration is complete, v2 is not
+// detected as active.
+//
+// Rows that are added to v1 after the migration has finished are not copied,
+// but they will be fetched from upstream again once replicas switch to v2.
+func MigrateV1ToV2(ctx context.Context, db *gorm.DB, batchSize int) error {
+	log := zerolog.Ctx(ctx)
+
+	src := v1.New(db)
+	dst := v2.New(db)
+	if err := dst.AutoMigrate(); err != nil {
+		return fmt.Errorf("creating v2 tables: %w", err)
+	}
+	if err := db.AutoMigrate(&v2.MigrationState{}); err != nil {
+		return fmt.Errorf("creating migration state table: %w", err)
+	}
+
+	var state v2.MigrationState
+	err := db.WithContext(ctx).Take(&state, "id = ?", 1).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// Everything added after this point will be picked up by
+		// the catch-up pass below.
+		state = v2.MigrationState{ID: 1}
+		if err := db.WithContext(ctx).Model(&v1.PLCLogEntry{}).Select("coalesce(max(id), 0)").Take(&state.MaxID).Error; err != nil {
+			return fmt.Errorf("getting max ID: %w", err)
+		}
+		if err := db.WithContext(ctx).Create(&state).Error; err != nil {
+			return fmt.Errorf("saving migration state: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("loading migration state: %w", err)
+	}
+
+	if state.Completed {
+		log.Info().Msgf("Migration has already been completed")
+		return nil
+	}
+
+	copyDIDs := func(dids []string) error {
+		logs, err := src.AuditLogsForDIDs(ctx, dids)
+		if err != nil {
+			return fmt.Errorf("reading v1 entries: %w", err)
+		}
+		if err := dst.ReplaceLogs(ctx, logs); err != nil {
+			return fmt.Errorf("writing v2 entries: %w", err)
+		}
+		return nil
+	}
+
+	// Initial pass: copy complete logs of all DIDs, in DID order, so that
+	// we know where to resume from.
+	copied := 0
+	lastReport := time.Now()
+	for {
+		var dids []string
+		err := db.WithContext(ctx).Model(&v1.PLCLogEntry{}).
+			Distinct("did").Where("did > ?", state.LastDID).Order("did").Limit(batchSize).
+			Pluck("did", &dids).Error
+		if err != nil {
+			return fmt.Errorf("listing DIDs: %w", err)
+		}
+		if len(dids) == 0 {
+			break
+		}
+
+		if err := copyDIDs(dids); err != nil {
+			return err
+		}
+		// Copying is idempotent, so if we crash before saving the cursor,
+		// the batch will simply be copied again.
+		state.LastDID = dids[len(dids)-1]
+		if err := db.WithContext(ctx).Save(&state).Error; err != nil {
+			return fmt.Errorf("saving migration state: %w", err)
+		}
+
+		copied += len(dids)
+		if time.Since(lastReport) > 10*time.Second {
+			log.Info().Msgf("Copied %d DIDs, last one is %q", copied, state.LastDID)
+			lastReport = time.Now()
+		}
+	}
+	log.Info().Msgf("Initial pass done, copied %d DIDs", copied)
+
+	// Catch-up pass: DIDs that got new entries since the start of
+	// the migration are copied again. This also takes care of entries
+	// that were nullified in the meantime, since nullification
+	// is always caused by a new entry.
+	//
+	// If v1 is still being updated, new rows will keep coming, so we stop
+	// once a pass finds only a few of them. Those are not copied, but
+	// the head set below is computed from rows with `id <= MaxID` only,
+	// so after switching to v2 they'll be fetched from upstream again.
+	for {
+		var pending struct {
+			MaxID uint
+			Count int64
+		}
+		err := db.WithContext(ctx).Model(&v1.PLCLogEntry{}).
+			Select("coalesce(max(id), 0) as max_id, count(*) as count").
+			Where("id > ?", state.MaxID).Take(&pending).Error
+		if err != nil {
+			return fmt.Errorf("counting new rows: %w", err)
+		}
+		if pending.Count < catchUpMinRows {
+			break
+		}
+		maxID := pending.MaxID
+
+		var dids []string
+		err = db.WithContext(ctx).Model(&v1.PLCLogEntry{}).
+			Distinct("did").Where("id > ? AND id <= ?", state.MaxID, maxID).
+			Pluck("did", &dids).Error
+		if err != nil {
+			return fmt.Errorf("listing updated DIDs: %w", err)
+		}
+		for len(dids) > 0 {
+			n := min(batchSize, len(dids))
+			if err := copyDIDs(dids[:n]); err != nil {
+				return err
+			}
+			dids = dids[n:]
+		}
+
+		state.MaxID = maxID
+		if err := db.WithContext(ctx).Save(&state).Error; err != nil {
+			return fmt.Errorf("saving migration state: %w", err)
+		}
+		log.Info().Msgf("Caught up to ID %d", maxID)
+	}
+
+	// Head is computed only from the rows that are known to be copied.
+	// Rows above MaxID might be copied too, but re-fetching them from
+	// upstream is harmless: duplicates are filtered out on ingestion.
+	var head struct {
+		Timestamp string
+		Seq       int64
+	}
+	err = db.WithContext(ctx).Model(&v1.PLCLogEntry{}).
+		Select("coalesce(max(plc_timestamp), '') as timestamp, coalesce(max(seq), 0) as seq").
+		Where("id <= ?", state.MaxID).Take(&head).Error
+	if err != nil {
+		return fmt.Errorf("getting head timestamp: %w", err)
+	}
+	if err := dst.SetHead(ctx, head.Timestamp, head.Seq); err != nil {
+		return fmt.Errorf("setting head timestamp: %w", err)
+	}
+
+	state.Completed = true
+	if err := db.WithContext(ctx).Save(&state).Error; err != nil {
+		return fmt.Errorf("saving migration state: %w", err)
+	}
+	log.Info().Msgf("Migration completed. Head timestamp: %q, seq: %d", head.Timestamp, head.Seq)
+	return nil
+}
@@ -2,14 +2,18 @@ package v1
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"bsky.watch/plc-mirror/models"
+	"bsky.watch/plc-mirror/util/leader"
+	"bsky.watch/plc-mirror/util/pgarray"
 	"bsky.watch/plc-mirror/util/plc"
 	"github.com/imax9000/errors"
 	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
 )
 
 func IsActive(ctx context.Context, db *gorm.DB) (bool, error) {
@@ -33,13 +37,40 @@ type PLCLogEntry struct {
 	ID        models.ID `gorm:"primarykey"`
 	CreatedAt time.Time
 
-	DID          string        `gorm:"column:did;index:did_timestamp;uniqueIndex:did_cid"`
-	CID          string        `gorm:"column:cid;uniqueIndex:did_cid"`
-	PLCTimestamp string        `gorm:"column:plc_timestamp;index:did_timestamp,sort:desc;index:,sort:desc"`
-	Nullified    bool          `gorm:"default:false"`
-	Operation    plc.Operation `gorm:"type:JSONB;serializer:json"`
+	DID          string    `gorm:"column:did;index:did_timestamp;uniqueIndex:did_cid"`
+	CID          string    `gorm:"column:cid;uniqueIndex:did_cid"`
+	PLCTimestamp string    `gorm:"column:plc_timestamp;index:did_timestamp,sort:desc;index:,sort:desc"`
+	Nullified    bool      `gorm:"default:false"`
+	Seq          int64     `gorm:"column:seq;default:0;index"`
+	Operation    Operation `gorm:"serializer:json"`
 }
 
+// Operation is stored as JSONB in PostgreSQL and as plain text in SQLite.
+type Operation struct {
+	plc.Operation
+}
+
+// GormDBDataType implements schema.GormDBDataTypeInterface.
+func (Operation) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if isSQLite(db) {
+		return "TEXT"
+	}
+	return "JSONB"
+}
+
+// MirrorState holds values that are shared between replicas. The table
+// always contains a single row.
+type MirrorState struct {
+	ID             int `gorm:"primarykey"`
+	LastCompletion time.Time
+}
+
+func (MirrorState) TableName() string {
+	return "mirror_state"
+}
+
+// Database implements storage in either PostgreSQL or, for single-node
+// deployments, SQLite.
 type Database struct {
 	db *gorm.DB
 }
@@ -48,8 +79,34 @@ func New(db *gorm.DB) *Database {
 	return &Database{db: db}
 }
 
+func isSQLite(db *gorm.DB) bool {
+	return db.Dialector.Name() == "sqlite"
+}
+
 func (d *Database) AutoMigrate() error {
-	return d.db.AutoMigrate(&PLCLogEntry{})
+	return d.db.AutoMigrate(&PLCLogEntry{}, &MirrorState{})
+}
+
+func (d *Database) LastCompletion(ctx context.Context) (time.Time, error) {
+	var state MirrorState
+	err := d.db.WithContext(ctx).Take(&state, "id = ?", 1).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, nil
+	}
+	return state.LastCompletion, err
+}
+
+func (d *Database) SetLastCompletion(ctx context.Context, t time.Time) error {
+	greatest := "greatest"
+	if isSQLite(d.db) {
+		greatest = "max"
+	}
+	// SQLite stores timestamps as strings, always use UTC to keep
+	// them comparable.
+	return d.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"last_completion": gorm.Expr(greatest + "(mirror_state.last_completion, EXCLUDED.last_completion)")}),
+	}).Create(&MirrorState{ID: 1, LastCompletion: t.UTC()}).Error
 }
 
 func (d *Database) HeadTimestamp(ctx context.Context) (string, error) {
@@ -58,30 +115,153 @@ func (d *Database) HeadTimestamp(ctx context.Context) (string, error) {
 	return ts, err
 }
 
+func (d *Database) HeadSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := d.db.WithContext(ctx).Model(&PLCLogEntry{}).Select("coalesce(max(seq), 0)").Take(&seq).Error
+	return seq, err
+}
+
+// AppendEntries checks the fencing token if there is one in `ctx`. There's
+// none with SQLite, since it's used only with a single process.
 func (d *Database) AppendEntries(ctx context.Context, entries []plc.OperationLogEntry) error {
-	return d.db.Clauses(
-		clause.OnConflict{
-			Columns:   []clause.Column{{Name: "did"}, {Name: "cid"}},
-			DoNothing: true,
-		},
-	).Create(mapSlice(entries, fromOperationLogEntry)).Error
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := leader.CheckFence(ctx, tx); err != nil {
+			return err
+		}
+		return tx.Clauses(
+			clause.OnConflict{
+				Columns:   []clause.Column{{Name: "did"}, {Name: "cid"}},
+				DoNothing: true,
+			},
+		).Create(mapSlice(entries, fromOperationLogEntry)).Error
+	})
 }
 
 func (d *Database) LastOperationForDID(ctx context.Context, did string) (*plc.OperationLogEntry, error) {
 	var entry PLCLogEntry
-	err := d.db.Model(&entry).Where("did = ? AND (NOT nullified)", did).Order("plc_timestamp desc").Limit(1).Take(&entry).Error
+	err := d.db.Model(&entry).Where("did = ? AND (NOT nullified)", did).Order("plc_timestamp desc, id desc").Limit(1).Take(&entry).Error
+	if err != nil {
+		return nil, err
+	}
+
+	r := toOperationLogEntry(entry)
+	return &r, nil
+}
+
+func (d *Database) OperationForDIDAt(ctx context.Context, did string, at string) (*plc.OperationLogEntry, error) {
+	var entry PLCLogEntry
+	err := d.db.WithContext(ctx).Model(&entry).Where("did = ? AND (NOT nullified) AND plc_timestamp <= ?", did, at).Order("plc_timestamp desc, id desc").Limit(1).Take(&entry).Error
+	if err != nil {
+		return nil, err
+	}
+
+	r := toOperationLogEntry(entry)
+	return &r, nil
+}
+
+func (d *Database) LastOperationsForDIDs(ctx context.Context, dids []string) (map[string]*plc.OperationLogEntry, error) {
+	r := map[string]*plc.OperationLogEntry{}
+	if len(dids) == 0 {
+		return r, nil
+	}
+
+	var entries []PLCLogEntry
+	var err error
+	if isSQLite(d.db) {
+		// SQLite doesn't support DISTINCT ON, so fetch complete logs
+		// and let later entries overwrite earlier ones.
+		err = d.db.WithContext(ctx).Model(&PLCLogEntry{}).
+			Where("did in ? AND (NOT nullified)", dids).
+			Order("plc_timestamp asc, id asc").
+			Find(&entries).Error
+	} else {
+		err = d.db.WithContext(ctx).Model(&PLCLogEntry{}).
+			Select("distinct on (did) *").
+			Where("did = any(?) AND (NOT nullified)", pgarray.Text(dids)).
+			Order("did, plc_timestamp desc, id desc").
+			Find(&entries).Error
+	}
 	if err != nil {
 		return nil, err
 	}
+	for _, entry := range entries {
+		e := toOperationLogEntry(entry)
+		r[entry.DID] = &e
+	}
+	return r, nil
+}
+
+func (d *Database) AuditLogForDID(ctx context.Context, did string) ([]plc.OperationLogEntry, error) {
+	var entries []PLCLogEntry
+	err := d.db.WithContext(ctx).Model(&PLCLogEntry{}).Where("did = ?", did).Order("plc_timestamp asc, id asc").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return mapSlice(entries, toOperationLogEntry), nil
+}
+
+func (d *Database) AuditLogsForDIDs(ctx context.Context, dids []string) (map[string][]plc.OperationLogEntry, error) {
+	r := map[string][]plc.OperationLogEntry{}
+	if len(dids) == 0 {
+		return r, nil
+	}
 
-	r := &plc.OperationLogEntry{
+	var entries []PLCLogEntry
+	err := d.db.WithContext(ctx).Model(&PLCLogEntry{}).Where("did in ?", dids).Order("plc_timestamp asc, id asc").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		r[entry.DID] = append(r[entry.DID], toOperationLogEntry(entry))
+	}
+	return r, nil
+}
+
+func (d *Database) NullifyEntries(ctx context.Context, entries map[string][]string) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := leader.CheckFence(ctx, tx); err != nil {
+			return err
+		}
+		for did, cids := range entries {
+			err := tx.Model(&PLCLogEntry{}).Where("did = ? AND cid in ?", did, cids).Update("nullified", true).Error
+			if err != nil {
+				return fmt.Errorf("updating entries for %q: %w", did, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) Export(ctx context.Context, after string, count int) ([]plc.OperationLogEntry, error) {
+	var entries []PLCLogEntry
+	err := d.db.WithContext(ctx).Model(&PLCLogEntry{}).Where("plc_timestamp > ?", after).Order("plc_timestamp asc, id asc").Limit(count).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return mapSlice(entries, toOperationLogEntry), nil
+}
+
+func (d *Database) ExportBySeq(ctx context.Context, after int64, count int) ([]plc.OperationLogEntry, error) {
+	var entries []PLCLogEntry
+	err := d.db.WithContext(ctx).Model(&PLCLogEntry{}).Where("seq > ?", after).Order("seq asc").Limit(count).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return mapSlice(entries, toOperationLogEntry), nil
+}
+
+func toOperationLogEntry(entry PLCLogEntry) plc.OperationLogEntry {
+	return plc.OperationLogEntry{
 		DID:       entry.DID,
 		CID:       entry.CID,
 		CreatedAt: entry.PLCTimestamp,
-		Operation: entry.Operation,
+		Operation: entry.Operation.Operation,
 		Nullified: entry.Nullified,
+		Seq:       entry.Seq,
 	}
-	return r, nil
 }
 
 func fromOperationLogEntry(op plc.OperationLogEntry) PLCLogEntry {
@@ -90,7 +270,8 @@ func fromOperationLogEntry(op plc.OperationLogEntry) PLCLogEntry {
 		CID:          op.CID,
 		PLCTimestamp: op.CreatedAt,
 		Nullified:    op.Nullified,
-		Operation:    op.Operation,
+		Seq:          op.Seq,
+		Operation:    Operation{op.Operation},
 	}
 }
 
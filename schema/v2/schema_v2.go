@@ -6,7 +6,10 @@ import (
 	"flag"
 	"fmt"
 	"slices"
+	"time"
 
+	"bsky.watch/plc-mirror/util/leader"
+	"bsky.watch/plc-mirror/util/pgarray"
 	"bsky.watch/plc-mirror/util/plc"
 	"github.com/imax9000/errors"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -19,8 +22,22 @@ var (
 )
 
 func IsActive(ctx context.Context, db *gorm.DB) (bool, error) {
+	// While data is being migrated from v1, the table is incomplete
+	// and must not be used.
+	var migration MigrationState
+	err := db.WithContext(ctx).Limit(1).Take(&migration).Error
+	if err == nil && !migration.Completed {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		pgErr, ok := errors.As[*pgconn.PgError](err)
+		if !ok || pgErr.Code != "42P01" {
+			return false, err
+		}
+	}
+
 	var entry DIDTableEntry
-	err := db.WithContext(ctx).Limit(1).Take(&entry).Error
+	err = db.WithContext(ctx).Limit(1).Take(&entry).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return false, nil
@@ -43,6 +60,25 @@ type DIDTableEntry struct {
 
 type HeadTimestamp struct {
 	Timestamp string
+	Seq       int64 `gorm:"not null;default:0"`
+	// LastCompletion is the last time the leader has finished polling
+	// upstream successfully.
+	LastCompletion *time.Time
+}
+
+// MigrationState tracks the progress of copying data from schema v1.
+// The table exists only if the migration has ever been started.
+type MigrationState struct {
+	ID int `gorm:"primarykey"`
+	// LastDID is the last DID that has been copied during the initial pass.
+	LastDID string
+	// MaxID is the highest ID of v1 rows that are known to be copied.
+	MaxID     uint
+	Completed bool
+}
+
+func (MigrationState) TableName() string {
+	return "v2_migration"
 }
 
 func (DIDTableEntry) TableName() string {
@@ -120,6 +156,27 @@ func (d *Database) HeadTimestamp(ctx context.Context) (string, error) {
 	return maxTimestamp, nil
 }
 
+func (d *Database) HeadSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := d.db.WithContext(ctx).Model(&HeadTimestamp{}).Select("coalesce(max(seq), 0)").Take(&seq).Error
+	return seq, err
+}
+
+func (d *Database) LastCompletion(ctx context.Context) (time.Time, error) {
+	var t *time.Time
+	err := d.db.WithContext(ctx).Model(&HeadTimestamp{}).Select("max(last_completion)").Take(&t).Error
+	if err != nil || t == nil {
+		return time.Time{}, err
+	}
+	return *t, nil
+}
+
+func (d *Database) SetLastCompletion(ctx context.Context, t time.Time) error {
+	return d.db.WithContext(ctx).
+		Exec("update head_timestamp set last_completion = ? where last_completion is null or last_completion < ?", t, t).
+		Error
+}
+
 func (d *Database) AppendEntries(ctx context.Context, entries []plc.OperationLogEntry) error {
 	if len(entries) == 0 {
 		return nil
@@ -128,6 +185,7 @@ func (d *Database) AppendEntries(ctx context.Context, entries []plc.OperationLog
 	if headTimestamp == "" {
 		return fmt.Errorf("failed to get the new head timestamp")
 	}
+	headSeq := plc.NextSeqCursor(entries)
 
 	// Sort in the reverse order, so that while iterating over the list
 	// and append()'ing to per-DID slices the newest entry will be
@@ -148,12 +206,22 @@ func (d *Database) AppendEntries(ctx context.Context, entries []plc.OperationLog
 		rows = append(rows, DIDTableEntry{DID: did, Log: entries})
 	}
 
-	return d.db.Transaction(func(tx *gorm.DB) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := leader.CheckFence(ctx, tx); err != nil {
+			return err
+		}
+
 		if !*useTrigger {
 			err := tx.Exec("update head_timestamp set timestamp = ? where timestamp < ?", headTimestamp, headTimestamp).Error
 			if err != nil {
 				return fmt.Errorf("updating head timestamp: %w", err)
 			}
+			if headSeq > 0 {
+				err := tx.Exec("update head_timestamp set seq = ? where seq < ?", headSeq, headSeq).Error
+				if err != nil {
+					return fmt.Errorf("updating head sequence number: %w", err)
+				}
+			}
 		}
 
 		return tx.Clauses(
@@ -167,6 +235,36 @@ func (d *Database) AppendEntries(ctx context.Context, entries []plc.OperationLog
 	})
 }
 
+// ReplaceLogs overwrites complete logs of the given DIDs. Entries must be
+// in chronological order. Used for migration from v1, since it's
+// idempotent, unlike AppendEntries.
+func (d *Database) ReplaceLogs(ctx context.Context, logs map[string][]plc.OperationLogEntry) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	rows := make([]DIDTableEntry, 0, len(logs))
+	for did, entries := range logs {
+		log := make(EntryLog, 0, len(entries))
+		for i := len(entries) - 1; i >= 0; i-- {
+			entry := entries[i]
+			entry.DID = ""
+			log = append(log, entry)
+		}
+		rows = append(rows, DIDTableEntry{DID: did, Log: log})
+	}
+	return d.db.WithContext(ctx).Clauses(
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "did"}},
+			DoUpdates: clause.AssignmentColumns([]string{"log"}),
+		},
+	).Create(rows).Error
+}
+
+// SetHead overwrites the head timestamp and sequence number.
+func (d *Database) SetHead(ctx context.Context, timestamp string, seq int64) error {
+	return d.db.WithContext(ctx).Exec("update head_timestamp set timestamp = ?, seq = ?", timestamp, seq).Error
+}
+
 func (d *Database) LastOperationForDID(ctx context.Context, did string) (*plc.OperationLogEntry, error) {
 	var entry DIDTableEntry
 	if err := d.db.First(&entry, "did = ?", did).Error; err != nil {
@@ -175,7 +273,108 @@ func (d *Database) LastOperationForDID(ctx context.Context, did string) (*plc.Op
 	if len(entry.Log) == 0 {
 		return nil, fmt.Errorf("no log entries present in the database")
 	}
-	r := entry.Log[0]
-	r.DID = entry.DID
-	return &r, nil
+	// Log is sorted newest first, so the first non-nullified entry
+	// is the current head.
+	for _, r := range entry.Log {
+		if r.Nullified {
+			continue
+		}
+		r.DID = entry.DID
+		return &r, nil
+	}
+	return nil, fmt.Errorf("all log entries are nullified")
+}
+
+func (d *Database) OperationForDIDAt(ctx context.Context, did string, at string) (*plc.OperationLogEntry, error) {
+	var entry DIDTableEntry
+	if err := d.db.WithContext(ctx).First(&entry, "did = ?", did).Error; err != nil {
+		return nil, err
+	}
+	// Log is sorted newest first.
+	for _, r := range entry.Log {
+		if r.Nullified || r.CreatedAt > at {
+			continue
+		}
+		r.DID = entry.DID
+		return &r, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (d *Database) LastOperationsForDIDs(ctx context.Context, dids []string) (map[string]*plc.OperationLogEntry, error) {
+	r := map[string]*plc.OperationLogEntry{}
+	if len(dids) == 0 {
+		return r, nil
+	}
+
+	var rows []DIDTableEntry
+	if err := d.db.WithContext(ctx).Where("did = any(?)", pgarray.Text(dids)).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for _, e := range row.Log {
+			if e.Nullified {
+				continue
+			}
+			e.DID = row.DID
+			r[row.DID] = &e
+			break
+		}
+	}
+	return r, nil
+}
+
+func (d *Database) AuditLogForDID(ctx context.Context, did string) ([]plc.OperationLogEntry, error) {
+	var entry DIDTableEntry
+	if err := d.db.WithContext(ctx).First(&entry, "did = ?", did).Error; err != nil {
+		return nil, err
+	}
+	return entry.chronologicalLog(), nil
+}
+
+// chronologicalLog returns log entries in chronological order, with
+// DID field populated.
+func (e DIDTableEntry) chronologicalLog() []plc.OperationLogEntry {
+	// Log is stored with the newest entry first.
+	r := slices.Clone(e.Log)
+	slices.Reverse(r)
+	for i := range r {
+		r[i].DID = e.DID
+	}
+	return r
+}
+
+func (d *Database) AuditLogsForDIDs(ctx context.Context, dids []string) (map[string][]plc.OperationLogEntry, error) {
+	r := map[string][]plc.OperationLogEntry{}
+	if len(dids) == 0 {
+		return r, nil
+	}
+
+	var rows []DIDTableEntry
+	if err := d.db.WithContext(ctx).Where("did in ?", dids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		r[row.DID] = row.chronologicalLog()
+	}
+	return r, nil
+}
+
+func (d *Database) NullifyEntries(ctx context.Context, entries map[string][]string) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := leader.CheckFence(ctx, tx); err != nil {
+			return err
+		}
+		for did, cids := range entries {
+			err := tx.Exec(`update data set log = array(
+					select case when e->>'cid' in ? then e || '{"nullified": true}'::jsonb else e end
+					from unnest(log) with ordinality as t(e, i)
+					order by i)
+				where did = ?`, cids, did).Error
+			if err != nil {
+				return fmt.Errorf("updating entries for %q: %w", did, err)
+			}
+		}
+		return nil
+	})
 }
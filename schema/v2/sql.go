@@ -3,12 +3,13 @@ package v2
 const triggerFunction = `create or replace function v2_update_head_timestamp() returns trigger as $end$
 	declare
 			rowTS text;
+			rowSeq bigint;
 	begin
 		if array_length(NEW.log, 1) = 0 then
 			return null;
 		end if;
 
-		select max(v->>'createdAt') into rowTS from unnest(NEW.log) as v;
+		select max(v->>'createdAt'), max((v->>'seq')::bigint) into rowTS, rowSeq from unnest(NEW.log) as v;
 		if not found then
 			return null;
 		end if;
@@ -16,6 +17,11 @@ const triggerFunction = `create or replace function v2_update_head_timestamp() r
 		update head_timestamp
 			set timestamp = rowTS
 			where timestamp < rowTS;
+		if rowSeq is not null then
+			update head_timestamp
+				set seq = rowSeq
+				where seq < rowSeq;
+		end if;
 		return null;
 	end;
 $end$ language plpgsql`
@@ -0,0 +1,451 @@
+// Package v3 stores each operation in a separate row of an append-only
+// table, and keeps the current state of each DID in a separate table,
+// so that resolving a DID doesn't require decoding its whole log.
+package v3
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/imax9000/errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"bsky.watch/plc-mirror/util/leader"
+	"bsky.watch/plc-mirror/util/pgarray"
+	"bsky.watch/plc-mirror/util/plc"
+)
+
+func IsActive(ctx context.Context, db *gorm.DB) (bool, error) {
+	var entry Operation
+	err := db.WithContext(ctx).Limit(1).Take(&entry).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		if err, ok := errors.As[*pgconn.PgError](err); ok {
+			if err.Code == "42P01" {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Operation is a single log entry. Rows are never deleted, and the only
+// column that is ever updated is `nullified`.
+type Operation struct {
+	ID           int64         `gorm:"primarykey"`
+	DID          string        `gorm:"column:did;index:did_timestamp;uniqueIndex:did_cid"`
+	CID          string        `gorm:"column:cid;uniqueIndex:did_cid"`
+	PLCTimestamp string        `gorm:"column:plc_timestamp;index:did_timestamp,sort:desc;index:,sort:desc"`
+	Seq          int64         `gorm:"column:seq;not null;default:0;index"`
+	Nullified    bool          `gorm:"not null;default:false"`
+	Operation    plc.Operation `gorm:"type:JSONB;serializer:json"`
+}
+
+func (Operation) TableName() string {
+	return "operations"
+}
+
+// DIDState is the current state of a DID, derived from its latest
+// non-nullified operation.
+type DIDState struct {
+	DID           string `gorm:"column:did;primarykey;index:pds_host_did,priority:2"`
+	HeadCID       string `gorm:"column:head_cid"`
+	HeadTimestamp string
+	Handle        string
+	PDSEndpoint   string `gorm:"column:pds_endpoint"`
+	// PDSHost is the lowercased hostname of PDSEndpoint. The column and
+	// the pds_host_did index were added after the initial v3 schema, on
+	// upgrade they are created by AutoMigrate and the column is filled in
+	// the next time the DID's state is updated.
+	PDSHost    string `gorm:"column:pds_host;index:pds_host_did,priority:1"`
+	SigningKey string
+	Tombstone  bool `gorm:"not null;default:false"`
+}
+
+func (DIDState) TableName() string {
+	return "did_state"
+}
+
+// AlsoKnownAs contains current alsoKnownAs values of all DIDs, for
+// reverse lookups. URIs are lowercased.
+//
+// The table was added after the initial v3 schema. On upgrade it and its
+// index are created by AutoMigrate, and rows for a DID are written the
+// next time its state is updated.
+type AlsoKnownAs struct {
+	DID string `gorm:"column:did;primarykey"`
+	URI string `gorm:"column:uri;primarykey;index"`
+}
+
+func (AlsoKnownAs) TableName() string {
+	return "also_known_as"
+}
+
+// MirrorState holds values that are shared between replicas. The table
+// always contains a single row.
+type MirrorState struct {
+	ID             int `gorm:"primarykey"`
+	LastCompletion time.Time
+}
+
+func (MirrorState) TableName() string {
+	return "v3_mirror_state"
+}
+
+type Database struct {
+	db *gorm.DB
+}
+
+func New(db *gorm.DB) *Database {
+	return &Database{db: db}
+}
+
+// AutoMigrate creates tables, columns and indexes that are missing,
+// including those added to the schema after a database was created.
+func (d *Database) AutoMigrate() error {
+	return d.db.AutoMigrate(&Operation{}, &DIDState{}, &AlsoKnownAs{}, &MirrorState{})
+}
+
+func (d *Database) LastCompletion(ctx context.Context) (time.Time, error) {
+	var state MirrorState
+	err := d.db.WithContext(ctx).Take(&state, "id = ?", 1).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, nil
+	}
+	return state.LastCompletion, err
+}
+
+func (d *Database) SetLastCompletion(ctx context.Context, t time.Time) error {
+	return d.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"last_completion": gorm.Expr("greatest(v3_mirror_state.last_completion, EXCLUDED.last_completion)")}),
+	}).Create(&MirrorState{ID: 1, LastCompletion: t}).Error
+}
+
+func (d *Database) HeadTimestamp(ctx context.Context) (string, error) {
+	ts := ""
+	err := d.db.WithContext(ctx).Model(&Operation{}).Select("plc_timestamp").Order("plc_timestamp desc").Limit(1).Take(&ts).Error
+	return ts, err
+}
+
+func (d *Database) HeadSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := d.db.WithContext(ctx).Model(&Operation{}).Select("coalesce(max(seq), 0)").Take(&seq).Error
+	return seq, err
+}
+
+func (d *Database) AppendEntries(ctx context.Context, entries []plc.OperationLogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := leader.CheckFence(ctx, tx); err != nil {
+			return err
+		}
+		err := tx.Clauses(
+			clause.OnConflict{
+				Columns:   []clause.Column{{Name: "did"}, {Name: "cid"}},
+				DoNothing: true,
+			},
+		).Create(mapSlice(entries, fromOperationLogEntry)).Error
+		if err != nil {
+			return err
+		}
+		return updateState(tx, uniqueDIDs(entries))
+	})
+}
+
+// updateState recomputes DIDState for the given DIDs from their latest
+// non-nullified operations.
+func updateState(tx *gorm.DB, dids []string) error {
+	var heads []Operation
+	err := tx.Model(&Operation{}).
+		Select("distinct on (did) *").
+		Where("did in ? and not nullified", dids).
+		Order("did, plc_timestamp desc, id desc").
+		Find(&heads).Error
+	if err != nil {
+		return fmt.Errorf("fetching head operations: %w", err)
+	}
+	if len(heads) == 0 {
+		return nil
+	}
+
+	states := mapSlice(heads, stateOf)
+	err = tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "did"}},
+		UpdateAll: true,
+	}).Create(states).Error
+	if err != nil {
+		return fmt.Errorf("updating DID state: %w", err)
+	}
+
+	err = tx.Where("did in ?", dids).Delete(&AlsoKnownAs{}).Error
+	if err != nil {
+		return fmt.Errorf("deleting old alsoKnownAs values: %w", err)
+	}
+	aka := []AlsoKnownAs{}
+	for _, head := range heads {
+		for _, uri := range alsoKnownAs(head.Operation.Value) {
+			aka = append(aka, AlsoKnownAs{DID: head.DID, URI: strings.ToLower(uri)})
+		}
+	}
+	if len(aka) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(aka).Error
+}
+
+// alsoKnownAs returns alsoKnownAs values of an operation. Tombstones
+// don't have any.
+func alsoKnownAs(op plc.OperationKind) []string {
+	switch v := op.(type) {
+	case plc.Op:
+		return v.AlsoKnownAs
+	case plc.LegacyCreateOp:
+		return v.AsUnsignedOp().AlsoKnownAs
+	}
+	return nil
+}
+
+func (d *Database) DIDsByAlsoKnownAs(ctx context.Context, uri string) ([]string, error) {
+	dids := []string{}
+	err := d.db.WithContext(ctx).Model(&AlsoKnownAs{}).
+		Where("uri = ?", strings.ToLower(uri)).
+		Order("did").
+		Pluck("did", &dids).Error
+	return dids, err
+}
+
+func stateOf(head Operation) DIDState {
+	r := DIDState{
+		DID:           head.DID,
+		HeadCID:       head.CID,
+		HeadTimestamp: head.PLCTimestamp,
+	}
+
+	var op plc.Op
+	switch v := head.Operation.Value.(type) {
+	case plc.Tombstone:
+		r.Tombstone = true
+		return r
+	case plc.Op:
+		op = v
+	case plc.LegacyCreateOp:
+		op = v.AsUnsignedOp()
+	}
+
+	for _, aka := range op.AlsoKnownAs {
+		if handle, ok := strings.CutPrefix(aka, "at://"); ok {
+			r.Handle = handle
+			break
+		}
+	}
+	if svc, ok := op.Services["atproto_pds"]; ok {
+		r.PDSEndpoint = svc.Endpoint
+		if u, err := url.Parse(svc.Endpoint); err == nil {
+			r.PDSHost = strings.ToLower(u.Hostname())
+		}
+	}
+	r.SigningKey = op.VerificationMethods["atproto"]
+	return r
+}
+
+func (d *Database) DIDsByPDSHost(ctx context.Context, host string, after string, limit int) ([]string, error) {
+	dids := []string{}
+	err := d.db.WithContext(ctx).Model(&DIDState{}).
+		Where("pds_host = ? and did > ? and not tombstone", strings.ToLower(host), after).
+		Order("did").
+		Limit(limit).
+		Pluck("did", &dids).Error
+	return dids, err
+}
+
+func (d *Database) PDSHostCounts(ctx context.Context) (map[string]int64, error) {
+	rows := []struct {
+		PDSHost string
+		Count   int64
+	}{}
+	err := d.db.WithContext(ctx).Model(&DIDState{}).
+		Select("pds_host, count(*) as count").
+		Where("pds_host <> '' and not tombstone").
+		Group("pds_host").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		r[row.PDSHost] = row.Count
+	}
+	return r, nil
+}
+
+func (d *Database) LastOperationForDID(ctx context.Context, did string) (*plc.OperationLogEntry, error) {
+	var entry Operation
+	err := d.db.WithContext(ctx).Model(&entry).
+		Select("operations.*").
+		Joins("join did_state on did_state.did = operations.did and did_state.head_cid = operations.cid").
+		Where("did_state.did = ?", did).
+		Take(&entry).Error
+	if err != nil {
+		return nil, err
+	}
+
+	r := toOperationLogEntry(entry)
+	return &r, nil
+}
+
+func (d *Database) OperationForDIDAt(ctx context.Context, did string, at string) (*plc.OperationLogEntry, error) {
+	var entry Operation
+	err := d.db.WithContext(ctx).Model(&entry).
+		Where("did = ? AND (NOT nullified) AND plc_timestamp <= ?", did, at).
+		Order("plc_timestamp desc, id desc").
+		Limit(1).
+		Take(&entry).Error
+	if err != nil {
+		return nil, err
+	}
+
+	r := toOperationLogEntry(entry)
+	return &r, nil
+}
+
+func (d *Database) LastOperationsForDIDs(ctx context.Context, dids []string) (map[string]*plc.OperationLogEntry, error) {
+	r := map[string]*plc.OperationLogEntry{}
+	if len(dids) == 0 {
+		return r, nil
+	}
+
+	var entries []Operation
+	err := d.db.WithContext(ctx).Model(&Operation{}).
+		Select("operations.*").
+		Joins("join did_state on did_state.did = operations.did and did_state.head_cid = operations.cid").
+		Where("did_state.did = any(?)", pgarray.Text(dids)).
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		e := toOperationLogEntry(entry)
+		r[entry.DID] = &e
+	}
+	return r, nil
+}
+
+func (d *Database) AuditLogForDID(ctx context.Context, did string) ([]plc.OperationLogEntry, error) {
+	var entries []Operation
+	err := d.db.WithContext(ctx).Model(&Operation{}).Where("did = ?", did).Order("plc_timestamp asc, id asc").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return mapSlice(entries, toOperationLogEntry), nil
+}
+
+func (d *Database) AuditLogsForDIDs(ctx context.Context, dids []string) (map[string][]plc.OperationLogEntry, error) {
+	r := map[string][]plc.OperationLogEntry{}
+	if len(dids) == 0 {
+		return r, nil
+	}
+
+	var entries []Operation
+	err := d.db.WithContext(ctx).Model(&Operation{}).Where("did in ?", dids).Order("plc_timestamp asc, id asc").Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		r[entry.DID] = append(r[entry.DID], toOperationLogEntry(entry))
+	}
+	return r, nil
+}
+
+func (d *Database) NullifyEntries(ctx context.Context, entries map[string][]string) error {
+	return d.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := leader.CheckFence(ctx, tx); err != nil {
+			return err
+		}
+		dids := make([]string, 0, len(entries))
+		for did, cids := range entries {
+			err := tx.Model(&Operation{}).Where("did = ? AND cid in ?", did, cids).Update("nullified", true).Error
+			if err != nil {
+				return fmt.Errorf("updating entries for %q: %w", did, err)
+			}
+			dids = append(dids, did)
+		}
+		if len(dids) == 0 {
+			return nil
+		}
+		return updateState(tx, dids)
+	})
+}
+
+func (d *Database) Export(ctx context.Context, after string, count int) ([]plc.OperationLogEntry, error) {
+	var entries []Operation
+	err := d.db.WithContext(ctx).Model(&Operation{}).Where("plc_timestamp > ?", after).Order("plc_timestamp asc, id asc").Limit(count).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return mapSlice(entries, toOperationLogEntry), nil
+}
+
+func (d *Database) ExportBySeq(ctx context.Context, after int64, count int) ([]plc.OperationLogEntry, error) {
+	var entries []Operation
+	err := d.db.WithContext(ctx).Model(&Operation{}).Where("seq > ?", after).Order("seq asc").Limit(count).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return mapSlice(entries, toOperationLogEntry), nil
+}
+
+func uniqueDIDs(entries []plc.OperationLogEntry) []string {
+	seen := map[string]bool{}
+	r := []string{}
+	for _, entry := range entries {
+		if !seen[entry.DID] {
+			seen[entry.DID] = true
+			r = append(r, entry.DID)
+		}
+	}
+	return r
+}
+
+func toOperationLogEntry(entry Operation) plc.OperationLogEntry {
+	return plc.OperationLogEntry{
+		DID:       entry.DID,
+		CID:       entry.CID,
+		CreatedAt: entry.PLCTimestamp,
+		Operation: entry.Operation,
+		Nullified: entry.Nullified,
+		Seq:       entry.Seq,
+	}
+}
+
+func fromOperationLogEntry(op plc.OperationLogEntry) Operation {
+	return Operation{
+		DID:          op.DID,
+		CID:          op.CID,
+		PLCTimestamp: op.CreatedAt,
+		Nullified:    op.Nullified,
+		Seq:          op.Seq,
+		Operation:    op.Operation,
+	}
+}
+
+func mapSlice[A any, B any](s []A, fn func(A) B) []B {
+	r := make([]B, 0, len(s))
+	for _, v := range s {
+		r = append(r, fn(v))
+	}
+	return r
+}
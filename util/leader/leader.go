@@ -0,0 +1,70 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Elector decides which of the replicas is allowed to write new entries
+// into the database.
+type Elector interface {
+	// TryLock attempts to become the leader without blocking.
+	TryLock(ctx context.Context) (bool, error)
+	// Check reports whether we're still the leader.
+	Check(ctx context.Context) (bool, error)
+	// Reset drops any local state after an error, so that leadership
+	// can be re-acquired from scratch.
+	Reset(ctx context.Context)
+	// Fence attaches the fencing token of the current leadership term
+	// to the context, if the implementation supports it. Writes made with
+	// the returned context are rejected once another replica takes over.
+	Fence(ctx context.Context) context.Context
+}
+
+// ErrStaleLeader is returned by writes that were made under a leadership
+// term that has already ended.
+var ErrStaleLeader = errors.New("leadership has been taken over by another replica")
+
+// Token identifies a single leadership term.
+type Token struct {
+	LockID int64
+	Holder string
+	Value  int64
+}
+
+type tokenKey struct{}
+
+func WithToken(ctx context.Context, token Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+func TokenFromContext(ctx context.Context) (Token, bool) {
+	token, ok := ctx.Value(tokenKey{}).(Token)
+	return token, ok
+}
+
+// CheckFence verifies that the fencing token attached to the context
+// (if any) is still current. It must be called inside the transaction
+// that performs the write: the lease row stays locked until the transaction
+// ends, so the leadership can't change in the meantime.
+func CheckFence(ctx context.Context, tx *gorm.DB) error {
+	token, ok := TokenFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	var current []int64
+	err := tx.WithContext(ctx).
+		Raw("select token from "+leaseTable+" where id = ? and holder = ? for share", token.LockID, token.Holder).
+		Scan(&current).Error
+	if err != nil {
+		return fmt.Errorf("checking fencing token: %w", err)
+	}
+	if len(current) == 0 || current[0] != token.Value {
+		return ErrStaleLeader
+	}
+	return nil
+}
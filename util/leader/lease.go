@@ -0,0 +1,122 @@
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const leaseTable = "leader_lease"
+
+const createLeaseTable = `create table if not exists ` + leaseTable + ` (
+	id bigint primary key,
+	holder text not null,
+	token bigint not null,
+	expires_at timestamptz not null
+)`
+
+// Lease is a leader election based on a row in the database, that has to
+// be periodically renewed. Unlike advisory locks, it doesn't need
+// a dedicated connection, so it works behind connection poolers, and it
+// provides a fencing token that is incremented on every takeover.
+type Lease struct {
+	pool     *pgxpool.Pool
+	lockID   int64
+	holder   string
+	duration time.Duration
+
+	mu    sync.Mutex
+	token int64
+}
+
+func NewLease(ctx context.Context, pool *pgxpool.Pool, id int64, duration time.Duration) (*Lease, error) {
+	if _, err := pool.Exec(ctx, createLeaseTable); err != nil {
+		return nil, fmt.Errorf("creating %s table: %w", leaseTable, err)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	return &Lease{
+		pool:     pool,
+		lockID:   id,
+		holder:   fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(b)),
+		duration: duration,
+	}, nil
+}
+
+func (l *Lease) TryLock(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var token int64
+	err := l.pool.QueryRow(ctx, `insert into `+leaseTable+` (id, holder, token, expires_at)
+		values ($1, $2, 1, now() + $3 * interval '1 second')
+		on conflict (id) do update
+			set holder = excluded.holder,
+				token = `+leaseTable+`.token + 1,
+				expires_at = excluded.expires_at
+			where `+leaseTable+`.expires_at < now()
+		returning token`,
+		l.lockID, l.holder, l.duration.Seconds()).Scan(&token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Somebody else holds an unexpired lease.
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("acquiring lease: %w", err)
+	}
+	l.token = token
+	return true, nil
+}
+
+// Check renews the lease if we still hold it.
+func (l *Lease) Check(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.token == 0 {
+		return false, nil
+	}
+
+	tag, err := l.pool.Exec(ctx, `update `+leaseTable+`
+		set expires_at = now() + $4 * interval '1 second'
+		where id = $1 and holder = $2 and token = $3 and expires_at > now()`,
+		l.lockID, l.holder, l.token, l.duration.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("renewing lease: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		// Lease has expired. Even if nobody has taken it over yet,
+		// we need to acquire it again with a new token.
+		l.token = 0
+		return false, nil
+	}
+	return true, nil
+}
+
+func (l *Lease) Reset(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.token = 0
+}
+
+func (l *Lease) Fence(ctx context.Context) context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.token == 0 {
+		return ctx
+	}
+	return WithToken(ctx, Token{LockID: l.lockID, Holder: l.holder, Value: l.token})
+}
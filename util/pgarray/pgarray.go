@@ -0,0 +1,36 @@
+// Package pgarray contains types for passing arrays as a single query
+// parameter, e.g. for `= ANY(?)`. gorm expands plain slices into
+// a list of parameters, which only works with `IN (?)` and produces
+// a different query text for each slice length.
+package pgarray
+
+import (
+	"database/sql/driver"
+	"strings"
+)
+
+// Text is encoded as a PostgreSQL text[] literal.
+type Text []string
+
+func (a Text) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	b := strings.Builder{}
+	b.WriteByte('{')
+	for i, s := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('"')
+		for _, c := range []byte(s) {
+			if c == '"' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
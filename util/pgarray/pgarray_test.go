@@ -0,0 +1,25 @@
+package pgarray
+
+import "testing"
+
+func TestTextValue(t *testing.T) {
+	cases := []struct {
+		in   Text
+		want any
+	}{
+		{nil, nil},
+		{Text{}, "{}"},
+		{Text{"did:plc:a", "did:plc:b"}, `{"did:plc:a","did:plc:b"}`},
+		{Text{`a"b`, `c\d`, "e,f", ""}, `{"a\"b","c\\d","e,f",""}`},
+	}
+	for _, tc := range cases {
+		got, err := tc.in.Value()
+		if err != nil {
+			t.Errorf("%q: Value() returned error: %s", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: Value() = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
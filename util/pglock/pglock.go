@@ -125,3 +125,9 @@ func (l *Lock) Reset(ctx context.Context) {
 	l.lockCount = 0
 	l.err = nil
 }
+
+// Fence returns ctx unchanged: advisory locks don't provide
+// a fencing token.
+func (l *Lock) Fence(ctx context.Context) context.Context {
+	return ctx
+}
@@ -0,0 +1,102 @@
+package plc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RecoveryWindow is how long after an operation a higher-priority rotation
+// key can still fork the chain and nullify it.
+const RecoveryWindow = 72 * time.Hour
+
+var (
+	ErrPrevNotFound = errors.New("previous operation not found")
+	ErrInvalidFork  = errors.New("invalid fork")
+)
+
+// Nullifies determines how a new entry fits into the existing log of a DID
+// and returns CIDs of the entries that it nullifies. `log` must be
+// in chronological order, with `Nullified` set according to the previously
+// applied entries.
+func Nullifies(log []OperationLogEntry, entry OperationLogEntry) ([]string, error) {
+	active := []OperationLogEntry{}
+	for _, e := range log {
+		if !e.Nullified {
+			active = append(active, e)
+		}
+	}
+
+	prev := PrevCID(entry.Operation.Value)
+	if prev == "" {
+		if len(active) > 0 {
+			return nil, fmt.Errorf("%w: DID already has a genesis operation", ErrInvalidFork)
+		}
+		return nil, nil
+	}
+
+	idx := -1
+	for i, e := range active {
+		if e.CID == prev {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		for _, e := range log {
+			if e.CID == prev {
+				return nil, fmt.Errorf("%w: previous operation %q is nullified", ErrInvalidFork, prev)
+			}
+		}
+		return nil, fmt.Errorf("%w: %q", ErrPrevNotFound, prev)
+	}
+
+	if idx == len(active)-1 {
+		// Regular update of the chain head.
+		return nil, nil
+	}
+
+	if _, ok := active[idx].Operation.Value.(Tombstone); ok {
+		return nil, fmt.Errorf("%w: previous operation is a tombstone", ErrInvalidFork)
+	}
+
+	// The new operation forks the chain. It's only allowed if it's signed
+	// by a higher-priority key than the first operation being nullified,
+	// and only within the recovery window.
+	forked := active[idx+1:]
+	keys := RotationKeys(active[idx].Operation.Value)
+
+	newKey, err := VerifySignature(entry.Operation.Value, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidFork, err)
+	}
+	oldKey, err := VerifySignature(forked[0].Operation.Value, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w: verifying operation %q: %w", ErrInvalidFork, forked[0].CID, err)
+	}
+	if newKey >= oldKey {
+		return nil, fmt.Errorf("%w: signed by rotation key #%d, which doesn't have a higher priority than #%d", ErrInvalidFork, newKey, oldKey)
+	}
+
+	forkTime, err := time.Parse(time.RFC3339, entry.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("parsing timestamp %q: %w", entry.CreatedAt, err)
+	}
+	forkedTime, err := time.Parse(time.RFC3339, forked[0].CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("parsing timestamp %q: %w", forked[0].CreatedAt, err)
+	}
+	if forkTime.Sub(forkedTime) > RecoveryWindow {
+		return nil, fmt.Errorf("%w: recovery window has passed", ErrInvalidFork)
+	}
+
+	return mapSlice(forked, func(e OperationLogEntry) string { return e.CID }), nil
+}
+
+func mapSlice[A any, B any](s []A, fn func(A) B) []B {
+	r := make([]B, 0, len(s))
+	for _, v := range s {
+		r = append(r, fn(v))
+	}
+	return r
+}
@@ -0,0 +1,131 @@
+package plc
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+)
+
+type testChain struct {
+	t    *testing.T
+	keys []atcrypto.PrivateKey
+	dids []string
+}
+
+func newTestChain(t *testing.T, n int) *testChain {
+	c := &testChain{t: t}
+	for i := 0; i < n; i++ {
+		k, err := atcrypto.GeneratePrivateKeyP256()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.keys = append(c.keys, k)
+		c.dids = append(c.dids, pub.DIDKey())
+	}
+	return c
+}
+
+// entry creates a new log entry signed by the key with index `key`.
+func (c *testChain) entry(prev *OperationLogEntry, key int, createdAt time.Time) OperationLogEntry {
+	c.t.Helper()
+	op := Op{
+		Type:         "plc_operation",
+		RotationKeys: c.dids,
+	}
+	if prev != nil {
+		op.Prev = &prev.CID
+	}
+	data, err := unsignedBytes(op)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sig, err := c.keys[key].HashAndSign(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	s := base64.RawURLEncoding.EncodeToString(sig)
+	op.Sig = &s
+	cid, err := op.CID()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return OperationLogEntry{
+		Operation: Operation{Value: op},
+		CID:       cid.String(),
+		CreatedAt: createdAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func TestNullifies(t *testing.T) {
+	c := newTestChain(t, 2)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	genesis := c.entry(nil, 1, start)
+	update := c.entry(&genesis, 1, start.Add(time.Hour))
+	log := []OperationLogEntry{genesis, update}
+
+	type testCase struct {
+		name    string
+		entry   OperationLogEntry
+		want    []string
+		wantErr error
+	}
+
+	cases := []testCase{
+		{
+			name:  "append",
+			entry: c.entry(&update, 1, start.Add(2*time.Hour)),
+		},
+		{
+			name:  "fork",
+			entry: c.entry(&genesis, 0, start.Add(2*time.Hour)),
+			want:  []string{update.CID},
+		},
+		{
+			name:    "fork with the same key",
+			entry:   c.entry(&genesis, 1, start.Add(2*time.Hour)),
+			wantErr: ErrInvalidFork,
+		},
+		{
+			name:    "fork after recovery window",
+			entry:   c.entry(&genesis, 0, start.Add(time.Hour+RecoveryWindow+time.Second)),
+			wantErr: ErrInvalidFork,
+		},
+		{
+			name:    "second genesis",
+			entry:   c.entry(nil, 0, start.Add(2*time.Hour)),
+			wantErr: ErrInvalidFork,
+		},
+		{
+			name:    "unknown prev",
+			entry:   c.entry(&OperationLogEntry{CID: "bafyreid5gxbqywpn7hwexgxzvjmbjssw6mv5mcyd37zuqysepcbnuqjcia"}, 0, start.Add(2*time.Hour)),
+			wantErr: ErrPrevNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		got, err := Nullifies(log, tc.entry)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: Nullifies() returned error %v, want %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%s: Nullifies() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Building on top of a nullified operation is not allowed.
+	nullified := slices.Clone(log)
+	nullified[1].Nullified = true
+	if _, err := Nullifies(nullified, c.entry(&update, 1, start.Add(2*time.Hour))); !errors.Is(err, ErrInvalidFork) {
+		t.Errorf("Nullifies() on top of a nullified op returned error %v, want %v", err, ErrInvalidFork)
+	}
+}
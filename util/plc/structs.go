@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
 	"github.com/multiformats/go-multicodec"
@@ -75,6 +76,9 @@ type OperationLogEntry struct {
 	CID       string    `json:"cid"`
 	Nullified bool      `json:"nullified,omitempty"`
 	CreatedAt string    `json:"createdAt"`
+	// Seq is a monotonically increasing sequence number assigned by
+	// upstream. Zero if upstream doesn't provide it.
+	Seq int64 `json:"seq,omitempty"`
 }
 
 func unmarshal[T any](b []byte) (T, error) {
@@ -148,6 +152,18 @@ func (o LegacyCreateOp) CID() (cid.Cid, error) {
 	return calculateCid(&o)
 }
 
+// TimestampFormat is the format of CreatedAt used by plc.directory.
+// Timestamps in this format can be compared as strings.
+const TimestampFormat = "2006-01-02T15:04:05.000Z"
+
+// FormatTimestamp formats `t` the same way as CreatedAt of log entries,
+// truncating it to milliseconds.
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(TimestampFormat)
+}
+
+// NextCursor returns the timestamp cursor to continue listing
+// from after `entries`.
 func NextCursor(entries []OperationLogEntry) string {
 	if len(entries) == 0 {
 		return ""
@@ -160,3 +176,17 @@ func NextCursor(entries []OperationLogEntry) string {
 	}
 	return cursor
 }
+
+// NextSeqCursor returns the sequence number cursor to continue listing
+// from after `entries`, or 0 if some of the entries don't have
+// a sequence number.
+func NextSeqCursor(entries []OperationLogEntry) int64 {
+	var cursor int64
+	for _, entry := range entries {
+		if entry.Seq == 0 {
+			return 0
+		}
+		cursor = max(cursor, entry.Seq)
+	}
+	return cursor
+}
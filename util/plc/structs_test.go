@@ -0,0 +1,16 @@
+package plc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatTimestamp(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.FixedZone("", 3*60*60))
+	if got, want := FormatTimestamp(ts), "2024-03-01T09:30:45.123Z"; got != want {
+		t.Errorf("FormatTimestamp() = %q, want %q", got, want)
+	}
+	if got, want := FormatTimestamp(ts.Truncate(time.Second)), "2024-03-01T09:30:45.000Z"; got != want {
+		t.Errorf("FormatTimestamp() = %q, want %q", got, want)
+	}
+}
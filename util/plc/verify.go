@@ -0,0 +1,150 @@
+package plc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+)
+
+var (
+	ErrMissingSignature = errors.New("operation is not signed")
+	ErrInvalidSignature = errors.New("signature doesn't match any of the rotation keys")
+)
+
+// RotationKeys returns the list of keys that are allowed to sign
+// operations following the given one, in the order of decreasing priority.
+func RotationKeys(op OperationKind) []string {
+	switch op := op.(type) {
+	case Op:
+		return op.RotationKeys
+	case LegacyCreateOp:
+		return []string{op.RecoveryKey, op.SigningKey}
+	}
+	return nil
+}
+
+// PrevCID returns the CID of the operation that the given one is building
+// upon, or an empty string for genesis operations.
+func PrevCID(op OperationKind) string {
+	switch op := op.(type) {
+	case Op:
+		if op.Prev != nil {
+			return *op.Prev
+		}
+	case LegacyCreateOp:
+		if op.Prev != nil {
+			return *op.Prev
+		}
+	case Tombstone:
+		return op.Prev
+	}
+	return ""
+}
+
+func signature(op OperationKind) *string {
+	switch op := op.(type) {
+	case Op:
+		return op.Sig
+	case LegacyCreateOp:
+		return op.Sig
+	case Tombstone:
+		return op.Sig
+	}
+	return nil
+}
+
+// unsignedBytes returns the CBOR encoding of the operation with
+// the signature removed, i.e., the data that the signature is computed over.
+func unsignedBytes(op OperationKind) ([]byte, error) {
+	b := bytes.NewBuffer(nil)
+	var err error
+	switch op := op.(type) {
+	case Op:
+		op.Sig = nil
+		err = op.MarshalCBOR(b)
+	case LegacyCreateOp:
+		op.Sig = nil
+		err = op.MarshalCBOR(b)
+	case Tombstone:
+		op.Sig = nil
+		err = op.MarshalCBOR(b)
+	default:
+		return nil, fmt.Errorf("unsupported operation type %T", op)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("marshaling as CBOR: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// VerifySignature checks that the operation is signed by one of the given
+// keys and returns the index of the matching key.
+func VerifySignature(op OperationKind, keys []string) (int, error) {
+	sig := signature(op)
+	if sig == nil || *sig == "" {
+		return -1, ErrMissingSignature
+	}
+	sigBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*sig, "="))
+	if err != nil {
+		return -1, fmt.Errorf("decoding signature: %w", err)
+	}
+	data, err := unsignedBytes(op)
+	if err != nil {
+		return -1, err
+	}
+
+	for i, k := range keys {
+		key, err := atcrypto.ParsePublicDIDKey(k)
+		if err != nil {
+			continue
+		}
+		if err := key.HashAndVerifyLenient(data, sigBytes); err == nil {
+			return i, nil
+		}
+	}
+	return -1, ErrInvalidSignature
+}
+
+// VerifyCID checks that the CID reported for the entry matches
+// the operation contents.
+func VerifyCID(entry OperationLogEntry) error {
+	c, err := entry.Operation.Value.CID()
+	if err != nil {
+		return fmt.Errorf("calculating CID: %w", err)
+	}
+	if c.String() != entry.CID {
+		return fmt.Errorf("CID mismatch: got %q, calculated %q", entry.CID, c.String())
+	}
+	return nil
+}
+
+// DIDFromGenesis computes the DID identifier from its signed genesis operation.
+func DIDFromGenesis(op OperationKind) (string, error) {
+	if PrevCID(op) != "" {
+		return "", fmt.Errorf("not a genesis operation")
+	}
+
+	b := bytes.NewBuffer(nil)
+	var err error
+	switch op := op.(type) {
+	case Op:
+		err = op.MarshalCBOR(b)
+	case LegacyCreateOp:
+		err = op.MarshalCBOR(b)
+	default:
+		return "", fmt.Errorf("unsupported genesis operation type %T", op)
+	}
+	if err != nil {
+		return "", fmt.Errorf("marshaling as CBOR: %w", err)
+	}
+
+	h := sha256.Sum256(b.Bytes())
+	id := strings.ToLower(base32.StdEncoding.EncodeToString(h[:]))
+	return "did:plc:" + id[:24], nil
+}
@@ -0,0 +1,91 @@
+package plc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// Test vector from github.com/bluesky-social/indigo/api/plc_test.go
+const (
+	legacyCreateOpJSON = `{
+		"type": "create",
+		"signingKey": "did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX",
+		"recoveryKey": "did:key:zDnaeRSYs7c2NpcNA5NRAUqS8DCkLWDyNLnATi28D6w7no7hX",
+		"handle": "why.bsky.social",
+		"service": "bsky.social",
+		"prev": null,
+		"sig": "e8h6dCx405Z_95cZWWkZtfLgDPvfdXDG9pCZQi1NhduooZgb4d1w-CzahA3J-iNGCCgP3D0O5l997G3vQfxKOA"
+	}`
+	legacyCreateOpUnsignedCBOR = "pmRwcmV29mR0eXBlZmNyZWF0ZWZoYW5kbGVvd2h5LmJza3kuc29jaWFsZ3NlcnZpY2VrYnNreS5zb2NpYWxqc2lnbmluZ0tleXg5ZGlkOmtleTp6RG5hZVJTWXM3YzJOcGNOQTVOUkFVcVM4RENrTFdEeU5MbkFUaTI4RDZ3N25vN2hYa3JlY292ZXJ5S2V5eDlkaWQ6a2V5OnpEbmFlUlNZczdjMk5wY05BNU5SQVVxUzhEQ2tMV0R5TkxuQVRpMjhENnc3bm83aFg"
+)
+
+func parseOp(t *testing.T, s string) OperationKind {
+	t.Helper()
+	var op Operation
+	if err := json.Unmarshal([]byte(s), &op); err != nil {
+		t.Fatalf("unmarshaling operation: %s", err)
+	}
+	return op.Value
+}
+
+func TestUnsignedBytes(t *testing.T) {
+	op := parseOp(t, legacyCreateOpJSON)
+
+	got, err := unsignedBytes(op)
+	if err != nil {
+		t.Fatalf("unsignedBytes() returned an error: %s", err)
+	}
+	want, err := base64.RawURLEncoding.DecodeString(legacyCreateOpUnsignedCBOR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("unsignedBytes() = %x, want %x", got, want)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	op := parseOp(t, legacyCreateOpJSON)
+
+	idx, err := VerifySignature(op, RotationKeys(op))
+	if err != nil {
+		t.Fatalf("VerifySignature() returned an error: %s", err)
+	}
+	if idx != 0 {
+		t.Errorf("VerifySignature() = %d, want 0", idx)
+	}
+
+	modified := op.(LegacyCreateOp)
+	modified.Handle = "someone.else"
+	if _, err := VerifySignature(modified, RotationKeys(op)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifySignature() on a modified op returned %v, want %v", err, ErrInvalidSignature)
+	}
+
+	modified = op.(LegacyCreateOp)
+	modified.Sig = nil
+	if _, err := VerifySignature(modified, RotationKeys(op)); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("VerifySignature() on an unsigned op returned %v, want %v", err, ErrMissingSignature)
+	}
+}
+
+func TestDIDFromGenesis(t *testing.T) {
+	op := parseOp(t, legacyCreateOpJSON)
+
+	got, err := DIDFromGenesis(op)
+	if err != nil {
+		t.Fatalf("DIDFromGenesis() returned an error: %s", err)
+	}
+	if want := "did:plc:unnby7mqlcvj5j4kxfpqgnyj"; got != want {
+		t.Errorf("DIDFromGenesis() = %q, want %q", got, want)
+	}
+
+	prev := "bafyreid5gxbqywpn7hwexgxzvjmbjssw6mv5mcyd37zuqysepcbnuqjcia"
+	modified := op.(LegacyCreateOp)
+	modified.Prev = &prev
+	if _, err := DIDFromGenesis(modified); err == nil {
+		t.Errorf("DIDFromGenesis() on a non-genesis op succeeded, want an error")
+	}
+}